@@ -0,0 +1,166 @@
+// Command migrate manages the chat database schema using the migrations
+// embedded in the binary.
+//
+// Usage:
+//
+//	migrate up             apply all pending migrations
+//	migrate down [N]       revert the N most recent migrations (default 1)
+//	migrate status         list applied and pending migrations
+//	migrate create <name>  add an empty up/down migration pair to -dir
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+	"github.com/FPT-OJT/minstant-ai.git/internal/repository"
+	"github.com/joho/godotenv"
+)
+
+// migrationNamePattern restricts names given to create to safe file names.
+var migrationNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+func main() {
+	dir := flag.String("dir", "db/migrations", "migrations directory used by create")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] up | down [N] | status | create <name>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// create only writes files and does not need a database.
+	if args[0] == "create" {
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := create(*dir, args[1]); err != nil {
+			log.Fatalf("create failed: %v", err)
+		}
+		return
+	}
+
+	ctx := context.Background()
+	_ = godotenv.Load() // optional .env file
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	pool, err := repository.NewPool(ctx, cfg.ChatDatabaseURL)
+	if err != nil {
+		log.Fatalf("failed to connect to chat database: %v", err)
+	}
+	defer pool.Close()
+
+	migrator, err := repository.NewMigrator(pool, repository.MigrationFiles())
+	if err != nil {
+		log.Fatalf("failed to load migrations: %v", err)
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			log.Printf("Applied migration %03d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("migration failed: %v", err)
+		}
+		if len(applied) == 0 {
+			log.Println("No pending migrations")
+		}
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatalf("invalid number of migrations: %s", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, n)
+		for _, m := range reverted {
+			log.Printf("Reverted migration %03d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("rollback failed: %v", err)
+		}
+	case "status":
+		if err := status(ctx, migrator); err != nil {
+			log.Fatalf("status failed: %v", err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// status prints every migration with its state.
+func status(ctx context.Context, migrator *repository.Migrator) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, st := range statuses {
+		state, appliedAt := "pending", "-"
+		if st.AppliedAt != nil {
+			state, appliedAt = "applied", st.AppliedAt.Format("2006-01-02 15:04:05 MST")
+		}
+		switch {
+		case st.Missing:
+			state = "applied, file missing"
+		case st.Modified:
+			state = "applied, file modified"
+		}
+		fmt.Fprintf(w, "%03d\t%s\t%s\t%s\n", st.Version, st.Name, state, appliedAt)
+	}
+	return w.Flush()
+}
+
+// create writes an empty migration pair numbered after the highest existing
+// version in dir.
+func create(dir, name string) error {
+	if !migrationNamePattern.MatchString(name) {
+		return fmt.Errorf("name must contain only lowercase letters, digits and underscores: %q", name)
+	}
+
+	migrations, err := repository.LoadMigrations(os.DirFS(dir))
+	if err != nil {
+		return err
+	}
+	var version int64 = 1
+	if len(migrations) > 0 {
+		version = migrations[len(migrations)-1].Version + 1
+	}
+
+	base := fmt.Sprintf("%03d_%s", version, name)
+	files := []struct{ name, content string }{
+		{base + ".sql", "-- Migration: \n"},
+		{base + ".down.sql", "-- Revert: \n"},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte(f.content), 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		log.Printf("Created %s", path)
+	}
+	return nil
+}
@@ -2,14 +2,17 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
+	"time"
 
 	appai "github.com/FPT-OJT/minstant-ai.git/internal/ai"
 	"github.com/FPT-OJT/minstant-ai.git/internal/ai/flow"
 	"github.com/FPT-OJT/minstant-ai.git/internal/ai/tool"
 	"github.com/FPT-OJT/minstant-ai.git/internal/config"
 	"github.com/FPT-OJT/minstant-ai.git/internal/middleware"
+	"github.com/FPT-OJT/minstant-ai.git/internal/ratelimit"
 	"github.com/FPT-OJT/minstant-ai.git/internal/repository"
 	"github.com/FPT-OJT/minstant-ai.git/internal/router"
 	"github.com/FPT-OJT/minstant-ai.git/internal/service"
@@ -18,10 +21,17 @@ import (
 )
 
 func main() {
+	skipMigrations := flag.Bool("skip-migrations", false,
+		"do not apply pending migrations on startup (run cmd/migrate as a separate step)")
+	flag.Parse()
+
 	ctx := context.Background()
 	_ = godotenv.Load() // optional .env file
 
-	cfg := config.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
 
 	// ---------- Query Database ----------
 	log.Println("Connecting to query database...")
@@ -39,13 +49,20 @@ func main() {
 	}
 	defer chatPool.Close()
 
-	log.Println("Running database migrations...")
-	if err := repository.RunMigrations(ctx, chatPool); err != nil {
-		log.Fatalf("migration failed: %v", err)
+	if *skipMigrations {
+		log.Println("Skipping database migrations")
+	} else {
+		log.Println("Running database migrations...")
+		if err := repository.RunMigrations(ctx, chatPool); err != nil {
+			log.Fatalf("migration failed: %v", err)
+		}
+		log.Println("Database migrations applied successfully")
 	}
-	log.Println("Database migrations applied successfully")
 
 	sessionStore := repository.NewPgSessionStore(chatPool)
+	sessionLocker := repository.NewPgSessionLocker(chatPool)
+	usageStore := repository.NewPgUsageStore(chatPool)
+	promptStore := repository.NewPgPromptStore(chatPool)
 
 	// ---------- AI / Genkit initialization ----------
 	g, err := appai.NewGenkit(ctx, cfg.AI)
@@ -54,20 +71,33 @@ func main() {
 	}
 
 	// Register AI tools and flows.
-	tools := tool.RegisterTools(g, queryPool)
-	flow.RegisterSmartWalletFlow(g, tools, sessionStore)
+	usageSvc := service.NewUsageService(cfg.Quota, usageStore)
+	tools := tool.RegisterTools(g, queryPool, cfg.Query)
+	flow.RegisterSessionTitleFlow(g, usageSvc, cfg.AI)
+	flow.RegisterSmartWalletFlow(g, tools, sessionStore, sessionStore, promptStore, usageSvc, cfg.AI)
 
 	// Choose the ChatService implementation.
-	var chatSvc service.ChatService = service.NewGenkitChatService()
+	var chatSvc service.ChatService = service.NewGenkitChatService(cfg.Chat, sessionStore, sessionLocker, usageSvc)
+	sessionSvc := service.NewSessionService(sessionStore)
+	adminSvc := service.NewAdminService(sessionStore, usageStore, promptStore)
+
+	// ---------- Rate limiting ----------
+	var rateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimit.Store == config.RateLimitStorePostgres {
+		pgStore := repository.NewPgRateLimitStore(chatPool, cfg.RateLimit.StreamLease)
+		go pruneRateLimits(ctx, pgStore)
+		rateLimitStore = pgStore
+	}
+	limiter := middleware.NewRateLimiter(cfg.RateLimit, rateLimitStore)
 
 	// ---------- Chi server ----------
 	r := chi.NewRouter()
-	if err := middleware.SetupMiddleware(r, cfg); err != nil {
+	if err := middleware.SetupMiddleware(ctx, r, cfg, limiter); err != nil {
 		log.Fatalf("failed to setup middleware: %v", err)
 	}
 
 	// Register routes
-	router.Setup(r, chatSvc)
+	router.Setup(r, chatSvc, sessionSvc, usageSvc, adminSvc, limiter, cfg.Auth.OperatorRoles)
 
 	// Start server
 	log.Printf("Starting server on :%s", cfg.Port)
@@ -75,3 +105,20 @@ func main() {
 		log.Fatalf("failed to start server: %v", err)
 	}
 }
+
+// pruneRateLimits periodically deletes idle rate limit buckets and expired
+// stream slots from the chat database.
+func pruneRateLimits(ctx context.Context, store *repository.PgRateLimitStore) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.Prune(ctx, time.Hour); err != nil {
+				log.Printf("failed to prune rate limits: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
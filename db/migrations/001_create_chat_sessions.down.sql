@@ -0,0 +1,3 @@
+-- Revert: Drop the chat_sessions table and all persisted chat state.
+
+DROP TABLE IF EXISTS chat_sessions;
@@ -0,0 +1,5 @@
+-- Revert: Remove chat session titles and the listing index.
+
+DROP INDEX IF EXISTS idx_chat_sessions_user_id_updated_at;
+
+ALTER TABLE chat_sessions DROP COLUMN IF EXISTS title;
@@ -0,0 +1,7 @@
+-- Migration: Add a user-visible title to chat sessions and support listing
+-- a user's sessions newest first.
+
+ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS title TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_chat_sessions_user_id_updated_at
+    ON chat_sessions(user_id, updated_at DESC);
@@ -0,0 +1,3 @@
+-- Revert: Drop chat session lock leases.
+
+DROP TABLE IF EXISTS chat_session_locks;
@@ -0,0 +1,10 @@
+-- Migration: Serialize the turns of a chat session across replicas with lease
+-- rows. A turn holds its session's lease while it runs, without pinning a
+-- database connection, and renews it; an expired lease is taken over, which
+-- frees the sessions of a replica that died.
+
+CREATE TABLE IF NOT EXISTS chat_session_locks (
+    session_id TEXT        PRIMARY KEY,
+    holder     UUID        NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
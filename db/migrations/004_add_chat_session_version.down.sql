@@ -0,0 +1,3 @@
+-- Revert: Remove the optimistic concurrency version from chat sessions.
+
+ALTER TABLE chat_sessions DROP COLUMN IF EXISTS version;
@@ -0,0 +1,7 @@
+-- Migration: Add an optimistic concurrency version to chat sessions. It is
+-- incremented on every save so a writer holding stale state can detect that
+-- another writer saved the session in between. Versions start at 1, so a
+-- state at version 0 has never been saved and saving it creates the session
+-- instead of overwriting an existing one.
+
+ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,5 @@
+-- Revert: Drop token usage records and per-user quota overrides.
+
+DROP TABLE IF EXISTS chat_user_quotas;
+
+DROP TABLE IF EXISTS chat_usage;
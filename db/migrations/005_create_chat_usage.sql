@@ -0,0 +1,30 @@
+-- Migration: Record token usage per chat turn and allow per-user quota
+-- overrides of the plan quotas. Besides the answer ('chat'), a turn may spend
+-- tokens summarizing older history ('summary') and titling its session
+-- ('title'); they are recorded as rows of their own kind.
+
+CREATE TABLE IF NOT EXISTS chat_usage (
+    id            BIGSERIAL   PRIMARY KEY,
+    user_id       UUID        NOT NULL,
+    session_id    TEXT        NOT NULL,
+    run_id        TEXT        NOT NULL,
+    kind          TEXT        NOT NULL DEFAULT 'chat',
+    model         TEXT        NOT NULL DEFAULT '',
+    input_tokens  INTEGER     NOT NULL DEFAULT 0,
+    output_tokens INTEGER     NOT NULL DEFAULT 0,
+    total_tokens  INTEGER     NOT NULL DEFAULT 0,
+    model_calls   INTEGER     NOT NULL DEFAULT 0,
+    tool_calls    INTEGER     NOT NULL DEFAULT 0,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_usage_user_id_created_at
+    ON chat_usage(user_id, created_at);
+
+-- A NULL limit falls back to the user's plan quota.
+CREATE TABLE IF NOT EXISTS chat_user_quotas (
+    user_id        UUID        PRIMARY KEY,
+    daily_tokens   BIGINT,
+    monthly_tokens BIGINT,
+    updated_at     TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
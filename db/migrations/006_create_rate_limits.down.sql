@@ -0,0 +1,5 @@
+-- Revert: Drop rate limit state.
+
+DROP TABLE IF EXISTS rate_limit_streams;
+
+DROP TABLE IF EXISTS rate_limit_buckets;
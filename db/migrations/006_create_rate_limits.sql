@@ -0,0 +1,17 @@
+-- Migration: Store rate limit token buckets and open stream slots shared by
+-- all replicas.
+
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    key        TEXT             PRIMARY KEY,
+    tokens     DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ      NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS rate_limit_streams (
+    id         UUID        PRIMARY KEY,
+    key        TEXT        NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_streams_key
+    ON rate_limit_streams(key);
@@ -0,0 +1,3 @@
+-- Revert: Drop prompt overrides.
+
+DROP TABLE IF EXISTS chat_prompts;
@@ -0,0 +1,9 @@
+-- Migration: Store operator-managed overrides of the built-in prompt
+-- templates.
+
+CREATE TABLE IF NOT EXISTS chat_prompts (
+    name       TEXT        PRIMARY KEY,
+    template   TEXT        NOT NULL,
+    updated_by TEXT        NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
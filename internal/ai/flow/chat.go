@@ -3,8 +3,13 @@ package flow
 
 import (
 	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
 
-	"github.com/FPT-OJT/minstant-ai.git/internal/constants"
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
 	"github.com/firebase/genkit/go/ai"
 	"github.com/firebase/genkit/go/core"
 	"github.com/firebase/genkit/go/core/x/session"
@@ -19,71 +24,264 @@ type ChatFlowInput struct {
 	Lat       *float64 `json:"lat"`
 	Long      *float64 `json:"long"`
 	UserId    string   `json:"userId"`
+	// RunID identifies the chat service run of the turn, if any, in the
+	// usage records of its summary and title.
+	RunID string `json:"runId,omitempty"`
+	// Config holds optional generation settings for this turn.
+	Config GenerationParams `json:"config"`
+}
+
+// UserMismatchError is returned when a flow input names another user than
+// the authenticated caller.
+type UserMismatchError struct {
+	UserID string
+}
+
+func (e *UserMismatchError) Error() string {
+	return "input user is not the authenticated caller: " + e.UserID
+}
+
+// callerContext returns ctx carrying the caller of a run and the caller's
+// user ID. Runs started by the chat service carry the verified principal,
+// and an input naming another user is rejected with a *UserMismatchError.
+// Other callers, such as the Genkit developer UI, carry no principal and
+// only name the user in the input.
+func callerContext(ctx context.Context, userID string) (context.Context, string, error) {
+	if caller, ok := auth.FromContext(ctx); ok {
+		if userID != "" {
+			if id, err := auth.ParseUserID(userID); err != nil || id != caller.UserID {
+				return ctx, "", &UserMismatchError{UserID: userID}
+			}
+		}
+		return ctx, caller.UserID, nil
+	}
+
+	id, err := auth.ParseUserID(userID)
+	if err != nil {
+		return ctx, "", err
+	}
+	return auth.NewContext(ctx, &auth.Principal{UserID: id}), id, nil
 }
 
 // SmartWalletFlow is the streaming Genkit flow for AI-powered chat.
-var SmartWalletFlow *core.Flow[ChatFlowInput, string, string]
+var SmartWalletFlow *core.Flow[ChatFlowInput, ChatFlowOutput, ChatChunk]
 
 // RegisterSmartWalletFlow defines and registers the SmartWallet streaming flow.
-// It uses the session store to persist conversation history across requests.
-func RegisterSmartWalletFlow(g *genkit.Genkit, tools []ai.Tool, store session.Store[ChatState]) {
+// It uses the session store to persist conversation history across requests,
+// and titles to store a generated title after a session's first reply. The
+// system prompt is taken from prompts when an operator has overridden it.
+// Answers use the config.ModelChat fallback chain of aiCfg, or the tier
+// requested in the input, and aiCfg.History bounds how much of the history
+// is sent to the model each turn. The usage of summarizing the history is
+// charged to the caller through usage.
+func RegisterSmartWalletFlow(g *genkit.Genkit, tools []ai.Tool, store session.Store[ChatState], titles TitleStore, prompts PromptStore, usage UsageRecorder, aiCfg config.AIConfig) {
 	toolRefs := make([]ai.ToolRef, len(tools))
 	for i, t := range tools {
 		toolRefs[i] = t
 	}
+	historyCfg := aiCfg.History
+	providers := providerTypes(aiCfg)
+	window := historyWindow{
+		g:         g,
+		cfg:       historyCfg,
+		model:     aiCfg.Model(config.ModelSummary),
+		modelOpts: modelOptions(aiCfg, config.ModelSummary),
+	}
 
 	SmartWalletFlow = genkit.DefineStreamingFlow(g, "smartWalletFlow",
-		func(ctx context.Context, input ChatFlowInput, sendChunk core.StreamCallback[string]) (string, error) {
+		func(ctx context.Context, input ChatFlowInput, sendChunk core.StreamCallback[ChatChunk]) (result ChatFlowOutput, err error) {
+			// The output of a failed flow is dropped, so a turn failing after
+			// model calls returns them in the error.
+			defer func() {
+				var interrupted *InterruptedError
+				if err != nil && result.Usage.ModelCalls > 0 && !errors.As(err, &interrupted) {
+					err = &FailedError{Output: result, Err: err}
+				}
+			}()
+
+			// The session store and tools scope their work to the caller.
+			ctx, input.UserId, err = callerContext(ctx, input.UserId)
+			if err != nil {
+				return ChatFlowOutput{}, err
+			}
+
 			// --- Session: load or create ---
-			ctxWithUser := context.WithValue(ctx, constants.UserContextKey{}, &input.UserId)
-			sess, err := session.Load(ctxWithUser, store, input.SessionID)
+			sess, err := loadOrCreateSession(ctx, store, input.SessionID)
 			if err != nil {
-				// Session not found — create a new one.
-				sess, err = session.New(ctx,
-					session.WithID[ChatState](input.SessionID),
-					session.WithStore(store),
-					session.WithInitialState(ChatState{History: []*ai.Message{}}),
-				)
-				if err != nil {
-					return "", err
-				}
+				return ChatFlowOutput{}, err
 			}
 
 			state := sess.State()
+			isFirstTurn := len(state.History) == 0
 
 			// Build the user message.
 			userMsg := ai.NewUserMessage(ai.NewTextPart(input.Message))
+			out := ChatFlowOutput{UserMessageID: withMessageID(userMsg)}
+
+			// Bound the context: older turns are folded into the summary.
+			system := systemPrompt(ctx, prompts, PromptData{
+				UserId:   input.UserId,
+				FullName: input.FullName,
+				Lat:      input.Lat,
+				Lng:      input.Long,
+			})
+			fixedTokens := estimateTextTokens(system) + estimateTokens([]*ai.Message{userMsg})
+			var summaryUsage ChatUsage
+			history := window.messages(ctx, &state, fixedTokens, &summaryUsage)
+			recordSideUsage(ctx, usage, SideUsage{
+				Kind:      UsageSummary,
+				SessionID: input.SessionID,
+				RunID:     input.RunID,
+				Model:     window.model,
+				Usage:     summaryUsage,
+			})
 
 			// Prepare generate options.
+			var recorder turnRecorder
 			opts := []ai.GenerateOption{
-				ai.WithSystem(GeneratePrompt(input.UserId, input.FullName, input.Lat, input.Long)),
-				ai.WithMessages(append(state.History, userMsg)...),
+				ai.WithSystem(withSummary(system, state.Summary)),
+				ai.WithMessages(append(slices.Clip(history), userMsg)...),
 				ai.WithTools(toolRefs...),
+				ai.WithMiddleware(usageMiddleware(&out.Usage), recorder.middleware),
 			}
 
-			stream := genkit.GenerateStream(ctx, g, opts...)
-
-			var fullResponse string
-			for result, err := range stream {
-				if err != nil {
-					return "", err
+			generator := fallbackGenerator{
+				g:         g,
+				models:    input.Config.modelChain(aiCfg),
+				retry:     aiCfg.Retry,
+				params:    input.Config,
+				providers: providers,
+			}
+			var partial strings.Builder
+			response, model, err := generator.generate(ctx, opts, func(chunk ChatChunk) error {
+				if chunk.Type == ChunkText {
+					partial.WriteString(chunk.Text)
 				}
-				if result.Done {
-					fullResponse = result.Response.Text()
-					break
+				return sendChunk(ctx, chunk)
+			})
+			if err != nil {
+				out.Model = model
+				if ctx.Err() != nil {
+					return savePartial(ctx, store, sess, state, userMsg, partial.String(), out)
 				}
-				chunk := result.Chunk.Text()
-				sendChunk(ctx, chunk)
+				return out, err
 			}
+			out.Model = model
+			out.Text = response.Text()
+			out.MessageID = withMessageID(response.Message)
+			response.Message.Metadata[modelKey] = model
 
 			// --- Session: save updated history ---
-			assistantMsg := ai.NewModelMessage(ai.NewTextPart(fullResponse))
-			state.History = append(state.History, userMsg, assistantMsg)
-			if err := sess.UpdateState(ctx, state); err != nil {
-				return fullResponse, err
+			// Keep the tool requests and responses of this turn so the next
+			// turn can reuse them and the answer can be audited.
+			turn := compactToolOutputs(recorder.turnMessages(userMsg, response.Message), historyCfg.MaxToolOutputBytes)
+			if err := saveTurn(ctx, store, sess, state, turn); err != nil {
+				return out, err
+			}
+
+			// Title the conversation in the background so the streamed
+			// response is not delayed.
+			if isFirstTurn {
+				go generateTitle(context.WithoutCancel(ctx), titles, TitleFlowInput{
+					SessionID:        input.SessionID,
+					RunID:            input.RunID,
+					UserMessage:      input.Message,
+					AssistantMessage: out.Text,
+				})
 			}
 
-			return fullResponse, nil
+			return out, nil
 		},
 	)
 }
+
+// maxSaveAttempts bounds how often saveTurn reloads a session that keeps
+// being modified concurrently.
+const maxSaveAttempts = 3
+
+// loadOrCreateSession loads the session, creating it with an empty state if
+// it does not exist yet.
+func loadOrCreateSession(ctx context.Context, store session.Store[ChatState], sessionID string) (*session.Session[ChatState], error) {
+	sess, err := session.Load(ctx, store, sessionID)
+	var notFound *session.NotFoundError
+	if !errors.As(err, &notFound) {
+		return sess, err
+	}
+
+	_, err = session.New(ctx,
+		session.WithID[ChatState](sessionID),
+		session.WithStore(store),
+		session.WithInitialState(ChatState{History: []*ai.Message{}}),
+	)
+	var conflict *SessionConflictError
+	if err != nil && !errors.As(err, &conflict) {
+		return nil, err
+	}
+	// Reload the session for its stored version, which later saves must
+	// match. On a conflict another turn created and saved it first.
+	return session.Load(ctx, store, sessionID)
+}
+
+// saveTurn appends the messages of a turn to state and saves it. If another
+// writer saved the session since state was loaded, the session is reloaded
+// and the turn appended to the newer history instead of overwriting it.
+func saveTurn(ctx context.Context, store session.Store[ChatState], sess *session.Session[ChatState], state ChatState, turn []*ai.Message) error {
+	for attempt := 1; ; attempt++ {
+		state.History = append(state.History, turn...)
+		err := sess.UpdateState(ctx, state)
+		var conflict *SessionConflictError
+		if !errors.As(err, &conflict) || attempt == maxSaveAttempts {
+			return err
+		}
+
+		sess, err = session.Load(ctx, store, sess.ID())
+		if err != nil {
+			return err
+		}
+		state = sess.State()
+	}
+}
+
+// savePartial saves the user message and the answer streamed so far, marked
+// as interrupted, after the turn's context was cancelled. It returns an
+// *InterruptedError carrying the partial output.
+func savePartial(ctx context.Context, store session.Store[ChatState], sess *session.Session[ChatState], state ChatState, userMsg *ai.Message, text string, out ChatFlowOutput) (ChatFlowOutput, error) {
+	turn := []*ai.Message{userMsg}
+	if text != "" {
+		partialMsg := ai.NewModelMessage(ai.NewTextPart(text))
+		out.MessageID = withMessageID(partialMsg)
+		partialMsg.Metadata[interruptedKey] = true
+		if out.Model != "" {
+			partialMsg.Metadata[modelKey] = out.Model
+		}
+		turn = append(turn, partialMsg)
+	}
+	out.Text = text
+
+	// The turn's context is already cancelled; saving must not be.
+	if err := saveTurn(context.WithoutCancel(ctx), store, sess, state, turn); err != nil {
+		return out, err
+	}
+	return out, &InterruptedError{Output: out, Err: context.Cause(ctx)}
+}
+
+// generateTitle runs SessionTitleFlow for a session's first exchange and
+// stores the result, giving up after titleTimeout. Failures are logged; the
+// session simply stays untitled.
+func generateTitle(ctx context.Context, titles TitleStore, input TitleFlowInput) {
+	ctx, cancel := context.WithTimeout(ctx, titleTimeout)
+	defer cancel()
+
+	title, err := SessionTitleFlow.Run(ctx, input)
+	if err != nil {
+		log.Printf("failed to generate title for session %s: %v", input.SessionID, err)
+		return
+	}
+	if title == "" {
+		return
+	}
+
+	if err := titles.SetTitleIfEmpty(ctx, input.SessionID, title); err != nil {
+		log.Printf("failed to store title for session %s: %v", input.SessionID, err)
+	}
+}
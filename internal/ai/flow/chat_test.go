@@ -0,0 +1,56 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+)
+
+func TestCallerContext(t *testing.T) {
+	const (
+		caller = "2f1d7a0e-8c1b-4f5e-9a43-1d2c3b4a5f60"
+		other  = "9c8b7a6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+	)
+	verified := auth.NewContext(context.Background(), &auth.Principal{UserID: caller})
+
+	tests := []struct {
+		name         string
+		ctx          context.Context
+		input        string
+		want         string
+		wantMismatch bool
+		wantErr      bool
+	}{
+		{name: "principal matches input", ctx: verified, input: caller, want: caller},
+		{name: "principal matches non-canonical input", ctx: verified, input: strings.ToUpper(caller), want: caller},
+		{name: "principal without input user", ctx: verified, want: caller},
+		{name: "principal differs from input", ctx: verified, input: other, wantMismatch: true},
+		{name: "principal with invalid input user", ctx: verified, input: "alice", wantMismatch: true},
+		{name: "no principal", ctx: context.Background(), input: strings.ToUpper(other), want: other},
+		{name: "no principal and invalid input user", ctx: context.Background(), input: "alice", wantErr: true},
+		{name: "no principal and no input user", ctx: context.Background(), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, userID, err := callerContext(tt.ctx, tt.input)
+
+			var mismatch *UserMismatchError
+			if errors.As(err, &mismatch) != tt.wantMismatch || (err != nil) != (tt.wantErr || tt.wantMismatch) {
+				t.Fatalf("callerContext error = %v, want mismatch %v, error %v", err, tt.wantMismatch, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if userID != tt.want {
+				t.Fatalf("user = %q, want %q", userID, tt.want)
+			}
+			if p, ok := auth.FromContext(ctx); !ok || p.UserID != tt.want {
+				t.Fatalf("context principal = %+v, want user %q", p, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+	"github.com/openai/openai-go"
+	"google.golang.org/genai"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+// ollamaStatusPattern extracts the HTTP status from Ollama plugin errors,
+// which are plain formatted errors.
+var ollamaStatusPattern = regexp.MustCompile(`non-200 status: (\d{3})`)
+
+// fallbackGenerator streams a generation from the first model of a chain
+// that succeeds. Retryable failures are retried with exponential backoff
+// before moving on to the next model. Once a chunk has been streamed the
+// answer is committed to that model, and failures are returned as is.
+type fallbackGenerator struct {
+	g      *genkit.Genkit
+	models []string
+	retry  config.RetryConfig
+	// params are applied to every model, translated for its provider type
+	// (looked up in providers by provider name).
+	params    GenerationParams
+	providers map[string]string
+}
+
+// UnavailableError is returned when no model of a chain could answer. Err is
+// the failure of the last model tried.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return "no model available: " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// generate runs the generation described by opts, passing every chunk to
+// onChunk. It returns the final response and the model that produced it, or
+// an *UnavailableError if every model failed before streaming.
+func (f fallbackGenerator) generate(ctx context.Context, opts []ai.GenerateOption, onChunk func(ChatChunk) error) (*ai.ModelResponse, string, error) {
+	var lastErr error
+	for _, model := range f.models {
+		backoff := f.retry.InitialBackoff
+		for attempt := 1; ; attempt++ {
+			resp, streamed, err := f.stream(ctx, model, opts, onChunk)
+			if err == nil {
+				return resp, model, nil
+			}
+			if streamed || ctx.Err() != nil {
+				return nil, model, err
+			}
+			lastErr = err
+
+			if !isRetryable(err) || attempt >= f.retry.MaxAttempts {
+				log.Printf("model %s failed, falling back: %v", model, err)
+				break
+			}
+			log.Printf("model %s failed (attempt %d), retrying in %s: %v", model, attempt, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, model, lastErr
+			}
+			backoff = min(backoff*2, f.retry.MaxBackoff)
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("empty model chain")
+	}
+	return nil, "", &UnavailableError{Err: lastErr}
+}
+
+// stream runs a single generation with model. streamed reports whether any
+// chunk reached onChunk.
+func (f fallbackGenerator) stream(ctx context.Context, model string, opts []ai.GenerateOption, onChunk func(ChatChunk) error) (resp *ai.ModelResponse, streamed bool, err error) {
+	opts = append(slices.Clip(opts), ai.WithModelName(model))
+	if cfg := f.params.providerConfig(f.providers[providerOf(model)], true); cfg != nil {
+		opts = append(opts, ai.WithConfig(cfg))
+	}
+	for result, err := range genkit.GenerateStream(ctx, f.g, opts...) {
+		if err != nil {
+			return nil, streamed, err
+		}
+		if result.Done {
+			return result.Response, streamed, nil
+		}
+		for _, chunk := range chunksFrom(result.Chunk) {
+			streamed = true
+			if err := onChunk(chunk); err != nil {
+				return nil, streamed, err
+			}
+		}
+	}
+	return nil, streamed, errors.New("generation ended without a response")
+}
+
+// isRetryable reports whether a model call failed transiently: rate limited,
+// a server error, or a network timeout.
+func isRetryable(err error) bool {
+	if status, ok := statusCode(err); ok {
+		return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// statusCode returns the HTTP status of a failed provider API call.
+func statusCode(err error) (int, bool) {
+	var (
+		openaiErr    *openai.Error
+		anthropicErr *anthropic.Error
+		genaiErr     genai.APIError
+		genaiErrPtr  *genai.APIError
+	)
+	switch {
+	case errors.As(err, &openaiErr):
+		return openaiErr.StatusCode, true
+	case errors.As(err, &anthropicErr):
+		return anthropicErr.StatusCode, true
+	case errors.As(err, &genaiErr):
+		return genaiErr.Code, true
+	case errors.As(err, &genaiErrPtr):
+		return genaiErrPtr.Code, true
+	}
+	if m := ollamaStatusPattern.FindStringSubmatch(err.Error()); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		return status, true
+	}
+	return 0, false
+}
@@ -0,0 +1,99 @@
+package flow
+
+import (
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+// defaultAnthropicMaxTokens is sent to Anthropic models when the request sets
+// no limit, since their API requires one.
+const defaultAnthropicMaxTokens = 4096
+
+// GenerationParams are optional per-turn generation settings. They are
+// validated and clamped by the service layer before reaching the flow.
+type GenerationParams struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	MaxOutputTokens *int     `json:"maxOutputTokens,omitempty"`
+	// Tier selects the config.ModelFast or config.ModelAccurate model chain
+	// instead of config.ModelChat.
+	Tier string `json:"tier,omitempty"`
+}
+
+// modelChain returns the fallback chain answering a turn with these params.
+func (p GenerationParams) modelChain(aiCfg config.AIConfig) []string {
+	if p.Tier != "" {
+		if chain, ok := aiCfg.Models[p.Tier]; ok {
+			return chain
+		}
+	}
+	return aiCfg.ModelChain(config.ModelChat)
+}
+
+// providerConfig returns the request config understood by the plugin of
+// providerType, or nil to use the provider's defaults. Each plugin accepts
+// its SDK's request parameters as a map, so the keys differ per provider.
+// stream tells whether the config is for a streamed generation.
+func (p GenerationParams) providerConfig(providerType string, stream bool) map[string]any {
+	cfg := map[string]any{}
+	if p.Temperature != nil {
+		cfg["temperature"] = *p.Temperature
+	}
+
+	switch providerType {
+	case config.ProviderOpenAI:
+		if p.MaxOutputTokens != nil {
+			cfg["max_completion_tokens"] = *p.MaxOutputTokens
+		}
+		if stream {
+			// Streamed completions only report token usage when asked to,
+			// and the API refuses the option on other requests.
+			cfg["stream_options"] = map[string]any{"include_usage": true}
+		}
+	case config.ProviderAnthropic:
+		cfg["max_tokens"] = defaultAnthropicMaxTokens
+		if p.MaxOutputTokens != nil {
+			cfg["max_tokens"] = *p.MaxOutputTokens
+		}
+	case config.ProviderGoogleAI:
+		if p.MaxOutputTokens != nil {
+			cfg["maxOutputTokens"] = *p.MaxOutputTokens
+		}
+	default:
+		// The Ollama plugin does not support request options.
+		return nil
+	}
+
+	if len(cfg) == 0 {
+		return nil
+	}
+	return cfg
+}
+
+// providerTypes maps provider names to their types.
+func providerTypes(aiCfg config.AIConfig) map[string]string {
+	types := make(map[string]string, len(aiCfg.Providers))
+	for _, p := range aiCfg.Providers {
+		types[p.Name] = p.Type
+	}
+	return types
+}
+
+// providerOf returns the provider name of a "provider/model" reference.
+func providerOf(model string) string {
+	provider, _, _ := strings.Cut(model, "/")
+	return provider
+}
+
+// modelOptions returns the generate options selecting the primary model of a
+// logical model name, with the provider's default settings.
+func modelOptions(aiCfg config.AIConfig, logical string) []ai.GenerateOption {
+	model := aiCfg.Model(logical)
+	opts := []ai.GenerateOption{ai.WithModelName(model)}
+	if cfg := (GenerationParams{}).providerConfig(providerTypes(aiCfg)[providerOf(model)], false); cfg != nil {
+		opts = append(opts, ai.WithConfig(cfg))
+	}
+	return opts
+}
@@ -0,0 +1,271 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+// charsPerToken is the rough characters-per-token ratio used to estimate
+// prompt size without a provider-specific tokenizer.
+const charsPerToken = 4
+
+const summaryPrompt = `
+You maintain a running summary of a conversation between a user and a Smart Wallet & Payment Optimization Assistant.
+Update the existing summary with the new messages.
+
+Rules:
+- Keep facts the assistant needs later: the user's cards and wallets, stores and locations mentioned,
+  preferences, questions asked and the recommendations given.
+- Drop greetings, small talk and repeated information.
+- Keep it under 200 words.
+- Write in the same language as the user's messages.
+- Reply with the updated summary only.
+`
+
+// historyWindow applies the configured history policy to a session state.
+type historyWindow struct {
+	g   *genkit.Genkit
+	cfg config.HistoryConfig
+	// model generates the running summary, with modelOpts.
+	model     string
+	modelOpts []ai.GenerateOption
+}
+
+// messages returns the history to send to the model for the next turn. Turns
+// that fall outside the window are folded into state.Summary first, and
+// state.SummarizedCount advances past them. fixedTokens is the estimated size
+// of the prompt parts that are always sent (system prompt, new user message).
+//
+// If summarization fails the window is still applied for this turn, but the
+// state is left unchanged so the fold is retried on the next turn. The usage
+// of summarizing is added to usage.
+func (h historyWindow) messages(ctx context.Context, state *ChatState, fixedTokens int, usage *ChatUsage) []*ai.Message {
+	window := state.History[state.SummarizedCount:]
+	cut := h.cutIndex(window, fixedTokens+estimateTextTokens(state.Summary))
+	if cut == 0 {
+		return window
+	}
+
+	summary, err := h.summarize(ctx, state.Summary, window[:cut], usage)
+	if err != nil {
+		log.Printf("failed to summarize conversation history: %v", err)
+		return window[cut:]
+	}
+
+	state.Summary = summary
+	state.SummarizedCount += cut
+	return window[cut:]
+}
+
+// cutIndex returns how many leading messages of window must be folded into
+// the summary to respect the turn limit and the token budget. The most recent
+// turn is always kept.
+func (h historyWindow) cutIndex(window []*ai.Message, fixedTokens int) int {
+	starts := turnStarts(window)
+	if len(starts) <= 1 {
+		return 0
+	}
+
+	// Index into starts of the oldest turn kept verbatim.
+	keep := 0
+	if h.cfg.MaxTurns > 0 && len(starts) > h.cfg.MaxTurns {
+		keep = len(starts) - h.cfg.MaxTurns
+	}
+	if h.cfg.MaxTokens > 0 {
+		for keep < len(starts)-1 && fixedTokens+estimateTokens(window[starts[keep]:]) > h.cfg.MaxTokens {
+			keep++
+		}
+	}
+
+	return starts[keep]
+}
+
+// summarize folds msgs into the previous summary with a model call, adding
+// its usage to usage.
+func (h historyWindow) summarize(ctx context.Context, previous string, msgs []*ai.Message, usage *ChatUsage) (string, error) {
+	if previous == "" {
+		previous = "(none)"
+	}
+
+	opts := append(slices.Clip(h.modelOpts),
+		ai.WithSystem(summaryPrompt),
+		ai.WithPrompt("Existing summary:\n%s\n\nNew messages:\n%s", previous, transcript(msgs)),
+		ai.WithMiddleware(usageMiddleware(usage)),
+	)
+	resp, err := genkit.Generate(ctx, h.g, opts...)
+	if err != nil {
+		return "", fmt.Errorf("history summary: %w", err)
+	}
+
+	summary := strings.TrimSpace(resp.Text())
+	if summary == "" {
+		return "", fmt.Errorf("history summary: model returned an empty summary")
+	}
+	return summary, nil
+}
+
+// turnRecorder is a model middleware recording the tool requests and tool
+// responses exchanged while generating a turn. Streaming plugins may return
+// responses without their request, so the response history cannot be relied
+// on to hold them.
+type turnRecorder struct {
+	// exchanged holds the messages following the last user message of the
+	// latest successful model request.
+	exchanged []*ai.Message
+	recorded  bool
+}
+
+// middleware records the request of every successful model call. Each
+// request of the generate loop extends the previous one with the model's tool
+// requests and the tool responses, so the last one holds all of them, and a
+// retried or fallen back generation starts over.
+func (t *turnRecorder) middleware(next ai.ModelFunc) ai.ModelFunc {
+	return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+		resp, err := next(ctx, req, cb)
+		if err != nil {
+			return nil, err
+		}
+
+		t.recorded = false
+		for i := len(req.Messages) - 1; i >= 0; i-- {
+			if req.Messages[i].Role == ai.RoleUser {
+				t.exchanged = slices.Clone(req.Messages[i+1:])
+				t.recorded = true
+				break
+			}
+		}
+		return resp, nil
+	}
+}
+
+// turnMessages returns the messages produced by a turn: the user message,
+// the tool requests and tool responses recorded during generation, and the
+// final model message. If none could be recorded only the final model
+// message is kept alongside the user message.
+func (t *turnRecorder) turnMessages(userMsg, final *ai.Message) []*ai.Message {
+	if !t.recorded {
+		log.Printf("no model request recorded for the turn, saving it without tool messages")
+		return []*ai.Message{userMsg, final}
+	}
+	msgs := make([]*ai.Message, 0, len(t.exchanged)+2)
+	msgs = append(msgs, userMsg)
+	msgs = append(msgs, t.exchanged...)
+	return append(msgs, final)
+}
+
+// compactToolOutputs replaces tool response outputs larger than maxBytes
+// (as JSON) with a truncated preview so that large query results do not
+// bloat the stored session. It returns msgs unchanged when maxBytes is zero.
+func compactToolOutputs(msgs []*ai.Message, maxBytes int) []*ai.Message {
+	if maxBytes <= 0 {
+		return msgs
+	}
+
+	compacted := make([]*ai.Message, len(msgs))
+	for i, m := range msgs {
+		compacted[i] = m
+		if m.Role != ai.RoleTool {
+			continue
+		}
+
+		var parts []*ai.Part
+		for _, p := range m.Content {
+			if p.IsToolResponse() {
+				if b, err := json.Marshal(p.ToolResponse.Output); err == nil && len(b) > maxBytes {
+					p = ai.NewToolResponsePart(&ai.ToolResponse{
+						Name: p.ToolResponse.Name,
+						Ref:  p.ToolResponse.Ref,
+						Output: map[string]any{
+							"compacted":     true,
+							"originalBytes": len(b),
+							"preview":       strings.ToValidUTF8(string(b[:maxBytes]), ""),
+						},
+					})
+				}
+			}
+			parts = append(parts, p)
+		}
+		compacted[i] = &ai.Message{Role: m.Role, Content: parts, Metadata: m.Metadata}
+	}
+	return compacted
+}
+
+// withSummary appends the running summary to the system prompt.
+func withSummary(system, summary string) string {
+	if summary == "" {
+		return system
+	}
+	return system + `
+----------------------------------------
+EARLIER CONVERSATION SUMMARY (older turns not shown verbatim)
+----------------------------------------
+` + summary + "\n"
+}
+
+// turnStarts returns the indexes of the user messages that begin each turn.
+func turnStarts(msgs []*ai.Message) []int {
+	var starts []int
+	for i, m := range msgs {
+		if m.Role == ai.RoleUser {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+// transcript renders the text of msgs as "User:"/"Assistant:" lines.
+func transcript(msgs []*ai.Message) string {
+	var sb strings.Builder
+	for _, m := range msgs {
+		text := m.Text()
+		if text == "" {
+			continue
+		}
+		switch m.Role {
+		case ai.RoleUser:
+			sb.WriteString("User: ")
+		case ai.RoleModel:
+			sb.WriteString("Assistant: ")
+		default:
+			continue
+		}
+		sb.WriteString(text)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// estimateTokens approximates the token count of msgs, including tool
+// requests and responses.
+func estimateTokens(msgs []*ai.Message) int {
+	total := 0
+	for _, m := range msgs {
+		for _, p := range m.Content {
+			switch {
+			case p.IsToolRequest():
+				b, _ := json.Marshal(p.ToolRequest)
+				total += len(b)
+			case p.IsToolResponse():
+				b, _ := json.Marshal(p.ToolResponse)
+				total += len(b)
+			default:
+				total += len(p.Text)
+			}
+		}
+	}
+	return total / charsPerToken
+}
+
+// estimateTextTokens approximates the token count of s.
+func estimateTextTokens(s string) int {
+	return len(s) / charsPerToken
+}
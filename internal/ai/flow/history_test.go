@@ -0,0 +1,120 @@
+package flow
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/firebase/genkit/go/ai"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+// text10 is a message text estimated at 10 tokens.
+var text10 = strings.Repeat("x", 10*charsPerToken)
+
+func userMsg() *ai.Message  { return ai.NewUserMessage(ai.NewTextPart(text10)) }
+func modelMsg() *ai.Message { return ai.NewModelMessage(ai.NewTextPart(text10)) }
+
+func TestCutIndex(t *testing.T) {
+	// Three turns of 20 estimated tokens each.
+	threeTurns := []*ai.Message{userMsg(), modelMsg(), userMsg(), modelMsg(), userMsg(), modelMsg()}
+	// Two turns, the first with a tool call: user, tool request, tool
+	// response, answer.
+	withTools := []*ai.Message{
+		userMsg(),
+		ai.NewModelMessage(ai.NewToolRequestPart(&ai.ToolRequest{Name: "executeQuery", Ref: "1"})),
+		ai.NewMessage(ai.RoleTool, nil, ai.NewToolResponsePart(&ai.ToolResponse{Name: "executeQuery", Ref: "1", Output: "ok"})),
+		modelMsg(),
+		userMsg(),
+		modelMsg(),
+	}
+
+	tests := []struct {
+		name        string
+		cfg         config.HistoryConfig
+		window      []*ai.Message
+		fixedTokens int
+		want        int
+	}{
+		{"no limits", config.HistoryConfig{}, threeTurns, 1000, 0},
+		{"empty window", config.HistoryConfig{MaxTurns: 1, MaxTokens: 1}, nil, 0, 0},
+		{"single turn over budget", config.HistoryConfig{MaxTurns: 1, MaxTokens: 1}, threeTurns[:2], 100, 0},
+		{"turns within limit", config.HistoryConfig{MaxTurns: 3}, threeTurns, 0, 0},
+		{"drops oldest turn", config.HistoryConfig{MaxTurns: 2}, threeTurns, 0, 2},
+		{"keeps last turn only", config.HistoryConfig{MaxTurns: 1}, threeTurns, 0, 4},
+		{"tokens within budget", config.HistoryConfig{MaxTokens: 60}, threeTurns, 0, 0},
+		{"tokens over budget", config.HistoryConfig{MaxTokens: 59}, threeTurns, 0, 2},
+		{"fixed tokens count", config.HistoryConfig{MaxTokens: 45}, threeTurns, 10, 4},
+		{"budget below last turn", config.HistoryConfig{MaxTokens: 5}, threeTurns, 0, 4},
+		{"stricter limit wins", config.HistoryConfig{MaxTurns: 2, MaxTokens: 25}, threeTurns, 0, 4},
+		{"tool messages stay in their turn", config.HistoryConfig{MaxTurns: 1}, withTools, 0, 4},
+		{"leading reply", config.HistoryConfig{MaxTurns: 1}, threeTurns[1:], 0, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := historyWindow{cfg: tt.cfg}
+			if got := h.cutIndex(tt.window, tt.fixedTokens); got != tt.want {
+				t.Fatalf("cutIndex = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompactToolOutputs(t *testing.T) {
+	small := ai.NewToolResponsePart(&ai.ToolResponse{Name: "getTables", Ref: "1", Output: "ok"})
+	large := ai.NewToolResponsePart(&ai.ToolResponse{Name: "executeQuery", Ref: "2", Output: strings.Repeat("é", 100)})
+	msgs := []*ai.Message{
+		userMsg(),
+		ai.NewMessage(ai.RoleTool, map[string]any{"k": "v"}, small, large),
+		modelMsg(),
+	}
+
+	got := compactToolOutputs(msgs, 15)
+	if len(got) != len(msgs) {
+		t.Fatalf("got %d messages, want %d", len(got), len(msgs))
+	}
+	if got[0] != msgs[0] || got[2] != msgs[2] {
+		t.Fatal("non-tool messages were replaced")
+	}
+
+	tool := got[1]
+	if tool.Role != ai.RoleTool || tool.Metadata["k"] != "v" || len(tool.Content) != 2 {
+		t.Fatalf("tool message = %+v, want role, metadata and parts kept", tool)
+	}
+	if tool.Content[0] != small {
+		t.Fatal("small tool output was replaced")
+	}
+
+	resp := tool.Content[1].ToolResponse
+	if resp.Name != "executeQuery" || resp.Ref != "2" {
+		t.Fatalf("compacted response is %s/%s, want executeQuery/2", resp.Name, resp.Ref)
+	}
+	out, ok := resp.Output.(map[string]any)
+	if !ok {
+		t.Fatalf("compacted output = %#v, want a map", resp.Output)
+	}
+	// The output marshals to a quoted string of 100 two-byte runes.
+	if out["compacted"] != true || out["originalBytes"] != 202 {
+		t.Fatalf("compacted output = %v", out)
+	}
+	preview, _ := out["preview"].(string)
+	if len(preview) > 15 || !utf8.ValidString(preview) || !strings.HasPrefix(preview, `"é`) {
+		t.Fatalf("preview = %q, want a valid UTF-8 prefix of at most 15 bytes", preview)
+	}
+
+	if msgs[1].Content[1] != large {
+		t.Fatal("input message was modified")
+	}
+}
+
+func TestCompactToolOutputsDisabled(t *testing.T) {
+	msgs := []*ai.Message{
+		ai.NewMessage(ai.RoleTool, nil, ai.NewToolResponsePart(&ai.ToolResponse{Name: "executeQuery", Output: strings.Repeat("x", 100)})),
+	}
+	got := compactToolOutputs(msgs, 0)
+	if len(got) != 1 || got[0] != msgs[0] {
+		t.Fatal("messages changed with compaction disabled")
+	}
+}
@@ -2,9 +2,29 @@ package flow
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"html/template"
+	"log"
+	"sort"
 )
 
+// PromptSystem names the system prompt of the chat flow.
+const PromptSystem = "system"
+
+// defaultPrompts are the built-in templates of the prompts operators may
+// override, by name.
+var defaultPrompts = map[string]string{
+	PromptSystem: promptTemplate,
+}
+
+// PromptStore holds operator overrides of the built-in prompt templates.
+type PromptStore interface {
+	// Prompt returns the override of the named prompt, reporting false if
+	// there is none.
+	Prompt(ctx context.Context, name string) (string, bool, error)
+}
+
 const promptTemplate = `
 You are a Smart Wallet & Payment Optimization Assistant.
 
@@ -125,15 +145,71 @@ type PromptData struct {
 }
 
 func GeneratePrompt(userId string, fullName *string, lat *float64, lng *float64) string {
-	tpl := template.Must(template.New("prompt").Parse(promptTemplate))
-
-	var buf bytes.Buffer
-	_ = tpl.Execute(&buf, PromptData{
+	text, _ := renderPrompt(promptTemplate, PromptData{
 		UserId:   userId,
 		FullName: fullName,
 		Lat:      lat,
 		Lng:      lng,
 	})
+	return text
+}
+
+// systemPrompt renders the system prompt for data, using the override in
+// prompts if there is one. A missing or broken override falls back to the
+// built-in template.
+func systemPrompt(ctx context.Context, prompts PromptStore, data PromptData) string {
+	custom, ok, err := prompts.Prompt(ctx, PromptSystem)
+	if err != nil {
+		log.Printf("failed to load the %s prompt, using the default: %v", PromptSystem, err)
+	}
+	if ok {
+		text, err := renderPrompt(custom, data)
+		if err == nil {
+			return text
+		}
+		log.Printf("failed to render the custom %s prompt, using the default: %v", PromptSystem, err)
+	}
+	return GeneratePrompt(data.UserId, data.FullName, data.Lat, data.Lng)
+}
+
+// renderPrompt executes a prompt template with data.
+func renderPrompt(text string, data PromptData) (string, error) {
+	tpl, err := template.New("prompt").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// PromptNames lists the prompts operators may override.
+func PromptNames() []string {
+	names := make([]string, 0, len(defaultPrompts))
+	for name := range defaultPrompts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultPrompt returns the built-in template of the named prompt. It
+// reports false if no such prompt exists.
+func DefaultPrompt(name string) (string, bool) {
+	text, ok := defaultPrompts[name]
+	return text, ok
+}
 
-	return buf.String()
+// ValidatePrompt checks that text is a valid template for the named prompt
+// by rendering it with sample data.
+func ValidatePrompt(name, text string) error {
+	if _, ok := defaultPrompts[name]; !ok {
+		return fmt.Errorf("unknown prompt %q", name)
+	}
+	fullName, lat, lng := "Sample User", 10.7769, 106.7009
+	_, err := renderPrompt(text, PromptData{UserId: "00000000-0000-0000-0000-000000000000", FullName: &fullName, Lat: &lat, Lng: &lng})
+	return err
 }
@@ -2,10 +2,30 @@ package flow
 
 import "github.com/firebase/genkit/go/ai"
 
+// SessionConflictError is returned by a session store when a session was
+// saved by another writer after the state being saved was loaded.
+type SessionConflictError struct {
+	SessionID string
+}
+
+func (e *SessionConflictError) Error() string {
+	return "session was modified concurrently: " + e.SessionID
+}
+
 // ChatState holds the persistent state for a chat session.
 // It is serialized as JSON and stored in the chat_sessions table.
 type ChatState struct {
 	// History stores the full conversation history (user + model messages)
 	// for multi-turn context.
 	History []*ai.Message `json:"history"`
+	// Summary is a model-generated running summary of the turns that no
+	// longer fit in the history window.
+	Summary string `json:"summary,omitempty"`
+	// SummarizedCount is the number of leading History messages already
+	// folded into Summary; only History[SummarizedCount:] is sent verbatim.
+	SummarizedCount int `json:"summarizedCount,omitempty"`
+	// Version is the stored version the state was loaded at. It is managed
+	// by the session store, which rejects saves of an outdated version with
+	// a *SessionConflictError. Zero means the session has never been saved.
+	Version int64 `json:"version,omitempty"`
 }
@@ -0,0 +1,195 @@
+package flow
+
+import (
+	"context"
+	"log"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/google/uuid"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+)
+
+// Chunk types streamed by SmartWalletFlow.
+const (
+	ChunkText      = "text"
+	ChunkToolStart = "tool_start"
+	ChunkToolEnd   = "tool_end"
+)
+
+// ChatChunk is a single streamed piece of a SmartWallet flow response: either
+// answer text or a notification that a tool started or finished running.
+type ChatChunk struct {
+	Type string `json:"type"`
+	// Text is set for text chunks.
+	Text string `json:"text,omitempty"`
+	// Tool and ToolRef identify the tool call for tool_start and tool_end.
+	Tool    string `json:"tool,omitempty"`
+	ToolRef string `json:"toolRef,omitempty"`
+}
+
+// ChatUsage is the resource usage of a turn, summed over every model call
+// made while resolving tool requests.
+type ChatUsage struct {
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+	TotalTokens  int `json:"totalTokens"`
+	// ModelCalls is the number of model round-trips in the turn.
+	ModelCalls int `json:"modelCalls"`
+	// ToolCalls is the number of tool requests made by the model.
+	ToolCalls int `json:"toolCalls"`
+}
+
+// Kinds of model usage charged for a turn.
+const (
+	// UsageChat is the usage of the answer, returned in ChatFlowOutput.
+	UsageChat = "chat"
+	// UsageSummary is the usage of folding older history into the summary.
+	UsageSummary = "summary"
+	// UsageTitle is the usage of titling a new session.
+	UsageTitle = "title"
+)
+
+// SideUsage is the usage of the model calls a turn makes besides answering.
+type SideUsage struct {
+	// Kind is UsageSummary or UsageTitle.
+	Kind      string
+	SessionID string
+	RunID     string
+	Model     string
+	Usage     ChatUsage
+}
+
+// UsageRecorder charges side usage to a user, so that it counts against
+// their quotas like the answers do.
+type UsageRecorder interface {
+	RecordSideUsage(ctx context.Context, userID string, u SideUsage) error
+}
+
+// recordSideUsage charges u to the caller in ctx, if any model call was
+// made. Failures are logged.
+func recordSideUsage(ctx context.Context, recorder UsageRecorder, u SideUsage) {
+	userID, ok := auth.UserIDFromContext(ctx)
+	if !ok || u.Usage.ModelCalls == 0 {
+		return
+	}
+	if err := recorder.RecordSideUsage(context.WithoutCancel(ctx), userID, u); err != nil {
+		log.Printf("failed to record %s usage of session %s: %v", u.Kind, u.SessionID, err)
+	}
+}
+
+// ChatFlowOutput is the output schema for the SmartWallet chat flow.
+type ChatFlowOutput struct {
+	Text string `json:"text"`
+	// UserMessageID and MessageID identify the stored user message and
+	// final assistant message of the turn.
+	UserMessageID string `json:"userMessageId"`
+	MessageID     string `json:"messageId"`
+	// Model is the "provider/model" of the fallback chain that answered.
+	Model string    `json:"model"`
+	Usage ChatUsage `json:"usage"`
+}
+
+// Message metadata keys.
+const (
+	// messageIDKey holds a stable message ID.
+	messageIDKey = "id"
+	// interruptedKey marks an assistant message cut short by cancellation.
+	interruptedKey = "interrupted"
+	// modelKey holds the model that generated an assistant message.
+	modelKey = "model"
+)
+
+// InterruptedError is returned when a turn is cancelled before it completes.
+// The partial answer in Output has already been saved to the session.
+type InterruptedError struct {
+	Output ChatFlowOutput
+	Err    error
+}
+
+func (e *InterruptedError) Error() string {
+	return "chat turn interrupted: " + e.Err.Error()
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// FailedError is returned when a turn fails after making model calls. Output
+// holds what the turn had produced, so that its usage can still be charged.
+type FailedError struct {
+	Output ChatFlowOutput
+	Err    error
+}
+
+func (e *FailedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FailedError) Unwrap() error {
+	return e.Err
+}
+
+// withMessageID assigns a new ID to m and returns it.
+func withMessageID(m *ai.Message) string {
+	id := uuid.NewString()
+	if m.Metadata == nil {
+		m.Metadata = map[string]any{}
+	}
+	m.Metadata[messageIDKey] = id
+	return id
+}
+
+// MessageID returns the ID stored on m, or "" for messages saved before IDs
+// were assigned.
+func MessageID(m *ai.Message) string {
+	id, _ := m.Metadata[messageIDKey].(string)
+	return id
+}
+
+// IsInterrupted reports whether m is a partial answer saved after the turn
+// was cancelled.
+func IsInterrupted(m *ai.Message) bool {
+	interrupted, _ := m.Metadata[interruptedKey].(bool)
+	return interrupted
+}
+
+// chunksFrom converts a model response chunk into flow chunks. Tool request
+// parts that carry a name mark the start of a tool call (later argument
+// deltas have no name); tool response parts mark its end.
+func chunksFrom(c *ai.ModelResponseChunk) []ChatChunk {
+	var chunks []ChatChunk
+	for _, p := range c.Content {
+		switch {
+		case p.IsToolRequest() && p.ToolRequest.Name != "":
+			chunks = append(chunks, ChatChunk{Type: ChunkToolStart, Tool: p.ToolRequest.Name, ToolRef: p.ToolRequest.Ref})
+		case p.IsToolResponse():
+			chunks = append(chunks, ChatChunk{Type: ChunkToolEnd, Tool: p.ToolResponse.Name, ToolRef: p.ToolResponse.Ref})
+		case p.IsText() && p.Text != "" && c.Role != ai.RoleTool:
+			chunks = append(chunks, ChatChunk{Type: ChunkText, Text: p.Text})
+		}
+	}
+	return chunks
+}
+
+// usageMiddleware returns a model middleware that adds the usage of every
+// model call to usage.
+func usageMiddleware(usage *ChatUsage) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			resp, err := next(ctx, req, cb)
+			if err != nil {
+				return nil, err
+			}
+
+			usage.ModelCalls++
+			usage.ToolCalls += len(resp.ToolRequests())
+			if u := resp.Usage; u != nil {
+				usage.InputTokens += u.InputTokens
+				usage.OutputTokens += u.OutputTokens
+				usage.TotalTokens += u.TotalTokens
+			}
+			return resp, nil
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package flow
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core"
+	"github.com/firebase/genkit/go/genkit"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+// maxTitleLength caps generated titles (in characters) so a verbose model
+// reply cannot produce an unreadable sessions list.
+const maxTitleLength = 80
+
+// titleTimeout bounds the background generation of a title, so a hung
+// provider cannot hold its goroutine and connection forever.
+const titleTimeout = 30 * time.Second
+
+const titlePrompt = `
+You write titles for chat conversations in a payment assistant app.
+Summarize the conversation below into a short title of at most 6 words.
+
+Rules:
+- Write the title in the SAME LANGUAGE as the user's message.
+- Reply with the title only: no quotes, no trailing punctuation, no explanations.
+`
+
+// TitleFlowInput is the input schema for the session title flow.
+type TitleFlowInput struct {
+	// SessionID and RunID identify the titled session and the run of its
+	// first turn in the usage record of the title, if set.
+	SessionID        string `json:"sessionId,omitempty"`
+	RunID            string `json:"runId,omitempty"`
+	UserMessage      string `json:"userMessage"`
+	AssistantMessage string `json:"assistantMessage"`
+}
+
+// TitleStore persists generated session titles.
+type TitleStore interface {
+	// SetTitleIfEmpty stores title for the session unless it already has one
+	// (e.g. set by the user in the meantime).
+	SetTitleIfEmpty(ctx context.Context, sessionID, title string) error
+}
+
+// SessionTitleFlow summarizes the first exchange of a session into a short
+// title.
+var SessionTitleFlow *core.Flow[TitleFlowInput, string, struct{}]
+
+// RegisterSessionTitleFlow defines and registers the session title flow,
+// generating titles with the config.ModelTitle model of aiCfg. Their usage
+// is charged to the caller through usage.
+func RegisterSessionTitleFlow(g *genkit.Genkit, usage UsageRecorder, aiCfg config.AIConfig) {
+	model := aiCfg.Model(config.ModelTitle)
+	modelOpts := modelOptions(aiCfg, config.ModelTitle)
+	SessionTitleFlow = genkit.DefineFlow(g, "sessionTitleFlow",
+		func(ctx context.Context, input TitleFlowInput) (string, error) {
+			var titleUsage ChatUsage
+			opts := append(slices.Clip(modelOpts),
+				ai.WithSystem(titlePrompt),
+				ai.WithPrompt("User: %s\n\nAssistant: %s", input.UserMessage, input.AssistantMessage),
+				ai.WithMiddleware(usageMiddleware(&titleUsage)),
+			)
+			resp, err := genkit.Generate(ctx, g, opts...)
+			recordSideUsage(ctx, usage, SideUsage{
+				Kind:      UsageTitle,
+				SessionID: input.SessionID,
+				RunID:     input.RunID,
+				Model:     model,
+				Usage:     titleUsage,
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return cleanTitle(resp.Text()), nil
+		},
+	)
+}
+
+// cleanTitle strips quotes and surrounding whitespace from a generated title
+// and truncates it to maxTitleLength characters.
+func cleanTitle(title string) string {
+	title = strings.TrimSpace(title)
+	title = strings.Trim(title, "\"'`“”«»")
+	title = strings.TrimRight(title, ".!。")
+	title = strings.TrimSpace(title)
+
+	if r := []rune(title); len(r) > maxTitleLength {
+		title = strings.TrimSpace(string(r[:maxTitleLength]))
+	}
+	return title
+}
@@ -4,30 +4,128 @@ package ai
 import (
 	"context"
 	"fmt"
+	"strings"
 
-	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core/api"
 	"github.com/firebase/genkit/go/genkit"
+	"github.com/firebase/genkit/go/plugins/anthropic"
 	"github.com/firebase/genkit/go/plugins/compat_oai"
+	"github.com/firebase/genkit/go/plugins/googlegenai"
+	"github.com/firebase/genkit/go/plugins/ollama"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
 )
 
-// NewGenkit initializes and returns a Genkit instance configured with the
-// OpenAI-compatible plugin. The plugin is set up using the provided AIConfig
-// (API key, base URL, and default model).
+// defaultOllamaAddress is used when an Ollama provider has no base URL.
+const defaultOllamaAddress = "http://localhost:11434"
+
+// NewGenkit initializes and returns a Genkit instance with one plugin per
+// configured provider. Models are referenced as "provider/model"; the
+// ModelDefault logical model becomes Genkit's default model.
 func NewGenkit(ctx context.Context, cfg config.AIConfig) (*genkit.Genkit, error) {
-	if cfg.APIKey == "" {
-		return nil, fmt.Errorf("OPENAI_API_KEY is required")
+	if err := validateModels(cfg); err != nil {
+		return nil, err
 	}
 
-	plugin := compat_oai.OpenAICompatible{
-		Provider: "openai-compat",
-		APIKey:   cfg.APIKey,
-		BaseURL:  cfg.BaseURL,
+	var (
+		plugins []api.Plugin
+		ollamas = make(map[string]*ollama.Ollama)
+	)
+	for _, p := range cfg.Providers {
+		plugin, err := newPlugin(p)
+		if err != nil {
+			return nil, err
+		}
+		if o, ok := plugin.(*ollama.Ollama); ok {
+			ollamas[p.Name] = o
+		}
+		plugins = append(plugins, plugin)
 	}
 
 	g := genkit.Init(ctx,
-		genkit.WithPlugins(&plugin),
-		genkit.WithDefaultModel(fmt.Sprintf("openai-compat/%s", cfg.Model)),
+		genkit.WithPlugins(plugins...),
+		genkit.WithDefaultModel(cfg.Model(config.ModelDefault)),
 	)
 
+	// Ollama cannot discover models, so define the ones that are used.
+	for _, chain := range cfg.Models {
+		for _, ref := range chain {
+			provider, model, _ := strings.Cut(ref, "/")
+			if o, ok := ollamas[provider]; ok && !ollama.IsDefinedModel(g, model) {
+				o.DefineModel(g, ollama.ModelDefinition{Name: model, Type: "chat"}, &ai.ModelOptions{
+					Label: "Ollama - " + model,
+					Supports: &ai.ModelSupports{
+						Multiturn:  true,
+						SystemRole: true,
+						Tools:      true,
+					},
+				})
+			}
+		}
+	}
+
 	return g, nil
 }
+
+// newPlugin creates the Genkit plugin for a provider.
+func newPlugin(p config.ProviderConfig) (api.Plugin, error) {
+	if p.Type != config.ProviderOpenAI && p.Name != p.Type {
+		return nil, fmt.Errorf("provider %q: %s providers must be named %q", p.Name, p.Type, p.Type)
+	}
+	if p.APIKey == "" && p.Type != config.ProviderOllama {
+		return nil, fmt.Errorf("provider %q: API key is required", p.Name)
+	}
+
+	switch p.Type {
+	case config.ProviderOpenAI:
+		return &compat_oai.OpenAICompatible{
+			Provider: p.Name,
+			APIKey:   p.APIKey,
+			BaseURL:  p.BaseURL,
+		}, nil
+	case config.ProviderOllama:
+		address := p.BaseURL
+		if address == "" {
+			address = defaultOllamaAddress
+		}
+		return &ollama.Ollama{ServerAddress: address}, nil
+	case config.ProviderAnthropic:
+		return &anthropic.Anthropic{APIKey: p.APIKey, BaseURL: p.BaseURL}, nil
+	case config.ProviderGoogleAI:
+		return &googlegenai.GoogleAI{APIKey: p.APIKey}, nil
+	default:
+		return nil, fmt.Errorf("provider %q: unknown type %q", p.Name, p.Type)
+	}
+}
+
+// validateModels checks that providers are unique and that every model
+// reference names a configured provider.
+func validateModels(cfg config.AIConfig) error {
+	providers := make(map[string]bool, len(cfg.Providers))
+	for _, p := range cfg.Providers {
+		if providers[p.Name] {
+			return fmt.Errorf("provider %q is configured twice", p.Name)
+		}
+		providers[p.Name] = true
+	}
+
+	if len(cfg.Models[config.ModelDefault]) == 0 {
+		return fmt.Errorf("a %q model is required", config.ModelDefault)
+	}
+	for logical, chain := range cfg.Models {
+		if len(chain) == 0 {
+			return fmt.Errorf("model %q: no models configured", logical)
+		}
+		for _, ref := range chain {
+			provider, model, ok := strings.Cut(ref, "/")
+			if !ok || model == "" {
+				return fmt.Errorf("model %q: %q is not a provider/model reference", logical, ref)
+			}
+			if !providers[provider] {
+				return fmt.Errorf("model %q: unknown provider %q", logical, provider)
+			}
+		}
+	}
+	return nil
+}
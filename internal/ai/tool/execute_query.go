@@ -1,75 +1,159 @@
 package tool
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"strings"
 
 	"github.com/firebase/genkit/go/ai"
 	"github.com/firebase/genkit/go/genkit"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
 )
 
+// userIDSetting is the transaction-local setting carrying the caller's user
+// ID. Row-level security policies on the query database read it with
+// current_setting('app.user_id', true).
+const userIDSetting = "app.user_id"
+
 // ExecuteQueryInput is the input schema for the executeQuery tool.
 type ExecuteQueryInput struct {
 	Query string `json:"query" jsonschema_description:"SQL SELECT query to execute against the database"`
 }
 
-// maxRows is the maximum number of rows returned by executeQuery to prevent
-// excessive output in the AI context window.
-const maxRows = 100
+// Truncation reasons reported in ExecuteQueryOutput.TruncatedReason.
+const (
+	TruncatedRowLimit  = "row_limit"
+	TruncatedByteLimit = "byte_limit"
+)
 
-// forbiddenKeywords are SQL keywords that indicate a write/DDL operation.
-// The tool will reject any query containing these.
-var forbiddenKeywords = []string{
-	"INSERT", "UPDATE", "DELETE", "DROP", "ALTER", "TRUNCATE",
-	"CREATE", "GRANT", "REVOKE", "EXEC ", "EXECUTE ",
+// ExecuteQueryOutput is the output schema for the executeQuery tool.
+// Exactly one of Rows or Rejection is meaningful: when the query fails
+// validation, Rejection explains why and no rows are returned.
+type ExecuteQueryOutput struct {
+	Rows      []map[string]interface{} `json:"rows"`
+	Rejection *QueryRejection          `json:"rejection,omitempty"`
+	// Truncated is true when more rows were available than returned.
+	Truncated bool `json:"truncated"`
+	// TruncatedReason is "row_limit" or "byte_limit" when Truncated is set.
+	TruncatedReason string `json:"truncatedReason,omitempty"`
 }
 
-func registerExecuteQuery(g *genkit.Genkit, pool *pgxpool.Pool) *ai.ToolDef[ExecuteQueryInput, []map[string]interface{}] {
+func registerExecuteQuery(g *genkit.Genkit, pool *pgxpool.Pool, cfg config.QueryConfig) *ai.ToolDef[ExecuteQueryInput, ExecuteQueryOutput] {
 	return genkit.DefineTool(g, "executeQuery",
 		"Execute a read-only SQL SELECT query against the database and return the results as rows. "+
-			"Only SELECT statements are allowed; INSERT, UPDATE, DELETE, DROP, ALTER, etc. are rejected. "+
-			"Results are capped at 100 rows. Use getDbTables and getTableDefinition first to understand the schema.",
-		func(ctx *ai.ToolContext, input ExecuteQueryInput) ([]map[string]interface{}, error) {
-			// Guard: reject write/DDL operations.
-			upper := strings.ToUpper(strings.TrimSpace(input.Query))
-			for _, kw := range forbiddenKeywords {
-				if strings.Contains(upper, kw) {
-					return nil, fmt.Errorf("forbidden: only SELECT queries are allowed, found '%s'", kw)
-				}
+			"Only a single SELECT statement (optionally with a WITH clause) is allowed, and only get_* procedures, "+
+			"PostGIS ST_* functions and common builtin functions may be called. "+
+			"If the query is refused, the output contains a rejection with a code, reason and hint; fix the query and retry. "+
+			fmt.Sprintf("Results are capped at %d rows and %d bytes; when truncated is true, narrow the query "+
+				"(filters, aggregates, fewer columns) instead of assuming the rows are complete. ", cfg.MaxRows, cfg.MaxResponseBytes)+
+			"Use getDbTables and getTableDefinition first to understand the schema.",
+		func(ctx *ai.ToolContext, input ExecuteQueryInput) (ExecuteQueryOutput, error) {
+			// Guard: only a single read-only SELECT with allowlisted functions.
+			stmt, rej := validateReadOnlyQuery(input.Query)
+			if rej != nil {
+				return ExecuteQueryOutput{Rejection: rej}, nil
+			}
+
+			userID, ok := auth.UserIDFromContext(ctx)
+			if !ok {
+				return ExecuteQueryOutput{}, fmt.Errorf("executeQuery: missing authenticated user")
 			}
 
-			rows, err := pool.Query(ctx, input.Query)
+			tx, err := beginReadOnlyTx(ctx, pool, cfg, userID)
 			if err != nil {
-				return nil, fmt.Errorf("query execution failed: %w", err)
+				return ExecuteQueryOutput{}, err
+			}
+			defer tx.Rollback(context.WithoutCancel(ctx))
+
+			// Push the row cap down to the server; one extra row tells us
+			// whether the result was truncated.
+			limited := fmt.Sprintf("SELECT * FROM (\n%s\n) AS limited_query LIMIT %d", stmt, cfg.MaxRows+1)
+
+			rows, err := tx.Query(ctx, limited)
+			if err != nil {
+				return ExecuteQueryOutput{}, fmt.Errorf("query execution failed: %w", err)
 			}
 			defer rows.Close()
 
 			fieldDescs := rows.FieldDescriptions()
-			var results []map[string]interface{}
+			out := ExecuteQueryOutput{Rows: []map[string]interface{}{}}
+			size := 0
 
 			for rows.Next() {
-				if len(results) >= maxRows {
+				if len(out.Rows) >= cfg.MaxRows {
+					out.Truncated, out.TruncatedReason = true, TruncatedRowLimit
 					break
 				}
 
 				values, err := rows.Values()
 				if err != nil {
-					return nil, fmt.Errorf("failed to read row values: %w", err)
+					return ExecuteQueryOutput{}, fmt.Errorf("failed to read row values: %w", err)
 				}
 
 				row := make(map[string]interface{}, len(fieldDescs))
 				for i, fd := range fieldDescs {
 					row[string(fd.Name)] = values[i]
 				}
-				results = append(results, row)
+
+				encoded, err := json.Marshal(row)
+				if err != nil {
+					return ExecuteQueryOutput{}, fmt.Errorf("failed to encode row: %w", err)
+				}
+				if size+len(encoded) > cfg.MaxResponseBytes {
+					out.Truncated, out.TruncatedReason = true, TruncatedByteLimit
+					break
+				}
+				size += len(encoded)
+
+				out.Rows = append(out.Rows, row)
 			}
+			rows.Close()
 
 			if err := rows.Err(); err != nil {
-				return nil, fmt.Errorf("row iteration error: %w", err)
+				return ExecuteQueryOutput{}, fmt.Errorf("row iteration error: %w", err)
 			}
 
-			return results, nil
+			return out, nil
 		},
 	)
 }
+
+// beginReadOnlyTx starts a READ ONLY transaction with the configured
+// statement, lock and idle timeouts applied locally to the transaction. The
+// caller's user ID is exposed as app.user_id and, when configured, the
+// transaction switches to the restricted role so row-level security policies
+// scope every query to that user.
+func beginReadOnlyTx(ctx context.Context, pool *pgxpool.Pool, cfg config.QueryConfig, userID string) (pgx.Tx, error) {
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin read-only transaction: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`SELECT set_config('statement_timeout', $1, true),
+		        set_config('lock_timeout', $2, true),
+		        set_config('idle_in_transaction_session_timeout', $3, true),
+		        set_config($4, $5, true)`,
+		fmt.Sprintf("%dms", cfg.StatementTimeout.Milliseconds()),
+		fmt.Sprintf("%dms", cfg.LockTimeout.Milliseconds()),
+		fmt.Sprintf("%dms", cfg.IdleInTransactionTimeout.Milliseconds()),
+		userIDSetting, userID,
+	)
+	if err != nil {
+		tx.Rollback(ctx)
+		return nil, fmt.Errorf("failed to apply query limits: %w", err)
+	}
+
+	if cfg.Role != "" {
+		if _, err := tx.Exec(ctx, "SET LOCAL ROLE "+pgx.Identifier{cfg.Role}.Sanitize()); err != nil {
+			tx.Rollback(ctx)
+			return nil, fmt.Errorf("failed to switch to role %s: %w", cfg.Role, err)
+		}
+	}
+
+	return tx, nil
+}
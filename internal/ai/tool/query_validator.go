@@ -0,0 +1,254 @@
+package tool
+
+import (
+	"fmt"
+	"strings"
+
+	pganalyze "github.com/pganalyze/pg_query_go/v6"
+	pgquery "github.com/wasilibs/go-pgquery"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Rejection codes returned to the model when a query fails validation.
+const (
+	RejectSyntaxError        = "syntax_error"
+	RejectMultipleStatement  = "multiple_statements"
+	RejectNotSelect          = "not_select"
+	RejectSelectInto         = "select_into"
+	RejectLockingClause      = "locking_clause"
+	RejectDataModifying      = "data_modifying_statement"
+	RejectFunctionNotAllowed = "function_not_allowed"
+)
+
+// QueryRejection describes why a query was refused by the read-only
+// validator. It is returned to the model as part of the tool output so the
+// model can correct the query and try again.
+type QueryRejection struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// Error implements the error interface.
+func (r *QueryRejection) Error() string {
+	return fmt.Sprintf("%s: %s", r.Code, r.Reason)
+}
+
+// allowedFunctionPrefixes lists name prefixes of functions the model may call:
+// the application's get_* query procedures and PostGIS spatial functions.
+// They only match unqualified or public functions.
+var allowedFunctionPrefixes = []string{"get_", "st_"}
+
+// allowedFunctionSchemas lists the schemas a function call may be qualified
+// with. Several SQL constructs (EXTRACT, SUBSTRING, TRIM, AT TIME ZONE) are
+// parsed into pg_catalog-qualified calls.
+var allowedFunctionSchemas = map[string]bool{
+	"":           true,
+	"public":     true,
+	"pg_catalog": true,
+}
+
+// allowedFunctions lists side-effect free builtin functions the model may call.
+var allowedFunctions = toSet(
+	// aggregates
+	"count", "sum", "avg", "min", "max", "array_agg", "string_agg",
+	"json_agg", "jsonb_agg", "json_object_agg", "jsonb_object_agg",
+	"bool_and", "bool_or", "every",
+	// window functions
+	"row_number", "rank", "dense_rank", "percent_rank", "cume_dist", "ntile",
+	"lag", "lead", "first_value", "last_value", "nth_value",
+	// string functions
+	"lower", "upper", "initcap", "trim", "btrim", "ltrim", "rtrim",
+	"length", "char_length", "substring", "substr", "replace", "concat",
+	"concat_ws", "left", "right", "position", "strpos", "split_part",
+	"format", "lpad", "rpad", "reverse",
+	// math functions
+	"round", "floor", "ceil", "ceiling", "abs", "trunc", "mod", "power",
+	"sqrt", "sign", "radians", "degrees", "sin", "cos", "tan", "asin",
+	"acos", "atan", "atan2", "pi",
+	// date/time functions
+	"now", "date_trunc", "date_part", "extract", "age", "timezone",
+	"to_char", "to_date", "to_timestamp", "to_number", "make_date",
+	"make_time", "make_timestamp", "make_interval", "justify_interval",
+	// array and json functions
+	"array_length", "cardinality", "unnest", "array_position",
+	"to_json", "to_jsonb", "json_build_object", "jsonb_build_object",
+	"json_build_array", "jsonb_build_array", "json_array_elements",
+	"jsonb_array_elements", "json_array_elements_text",
+	"jsonb_array_elements_text", "jsonb_each", "jsonb_each_text",
+	"jsonb_extract_path", "jsonb_extract_path_text",
+	"json_extract_path_text", "jsonb_array_length",
+	// misc
+	"generate_series",
+)
+
+// validateReadOnlyQuery parses query with the PostgreSQL parser and checks that
+// it is a single read-only SELECT (optionally with a WITH clause) that only
+// calls allowlisted functions. On success it returns the statement text with
+// any trailing semicolon removed and a nil rejection.
+func validateReadOnlyQuery(query string) (string, *QueryRejection) {
+	tree, err := pgquery.Parse(query)
+	if err != nil {
+		return "", &QueryRejection{
+			Code:   RejectSyntaxError,
+			Reason: err.Error(),
+			Hint:   "Fix the SQL syntax and try again.",
+		}
+	}
+
+	if len(tree.GetStmts()) != 1 {
+		return "", &QueryRejection{
+			Code:   RejectMultipleStatement,
+			Reason: fmt.Sprintf("expected exactly one statement, found %d", len(tree.GetStmts())),
+			Hint:   "Send a single SELECT statement without additional statements separated by ';'.",
+		}
+	}
+
+	raw := tree.GetStmts()[0]
+	stmt := raw.GetStmt()
+	if stmt.GetSelectStmt() == nil {
+		return "", &QueryRejection{
+			Code:   RejectNotSelect,
+			Reason: fmt.Sprintf("statement type %s is not allowed", statementType(stmt)),
+			Hint:   "Only SELECT queries (optionally with a WITH clause) are allowed.",
+		}
+	}
+
+	if rej := walkNodes(stmt.ProtoReflect(), checkNode); rej != nil {
+		return "", rej
+	}
+
+	return statementText(query, raw), nil
+}
+
+// checkNode validates a single parse tree node.
+func checkNode(m proto.Message) *QueryRejection {
+	switch n := m.(type) {
+	case *pganalyze.SelectStmt:
+		if n.GetIntoClause() != nil {
+			return &QueryRejection{
+				Code:   RejectSelectInto,
+				Reason: "SELECT ... INTO creates a table and is not allowed",
+				Hint:   "Remove the INTO clause.",
+			}
+		}
+		if len(n.GetLockingClause()) > 0 {
+			return &QueryRejection{
+				Code:   RejectLockingClause,
+				Reason: "row locking clauses (FOR UPDATE/SHARE) are not allowed",
+				Hint:   "Remove the FOR UPDATE/FOR SHARE clause.",
+			}
+		}
+	case *pganalyze.InsertStmt, *pganalyze.UpdateStmt, *pganalyze.DeleteStmt, *pganalyze.MergeStmt:
+		return &QueryRejection{
+			Code:   RejectDataModifying,
+			Reason: "data-modifying statements are not allowed, including inside WITH clauses",
+			Hint:   "Use only SELECT inside WITH clauses and subqueries.",
+		}
+	case *pganalyze.FuncCall:
+		schema, name := functionName(n)
+		if !isAllowedFunction(schema, name) {
+			qualified := name
+			if schema != "" {
+				qualified = schema + "." + name
+			}
+			return &QueryRejection{
+				Code:   RejectFunctionNotAllowed,
+				Reason: fmt.Sprintf("function %q is not allowed", qualified),
+				Hint:   "Call only get_* procedures listed by getDbProcedures, PostGIS ST_* functions, or common aggregate/string/date functions.",
+			}
+		}
+	}
+	return nil
+}
+
+// walkNodes visits every message in the parse tree depth-first and stops at
+// the first rejection.
+func walkNodes(m protoreflect.Message, visit func(proto.Message) *QueryRejection) *QueryRejection {
+	if rej := visit(m.Interface()); rej != nil {
+		return rej
+	}
+
+	var rej *QueryRejection
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Message() == nil || fd.IsMap() {
+			return true
+		}
+		if fd.IsList() {
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				if rej = walkNodes(list.Get(i).Message(), visit); rej != nil {
+					return false
+				}
+			}
+			return true
+		}
+		rej = walkNodes(v.Message(), visit)
+		return rej == nil
+	})
+	return rej
+}
+
+// functionName returns the lower-cased schema (if qualified) and name of a
+// function call.
+func functionName(fc *pganalyze.FuncCall) (schema, name string) {
+	parts := make([]string, 0, len(fc.GetFuncname()))
+	for _, n := range fc.GetFuncname() {
+		parts = append(parts, strings.ToLower(n.GetString_().GetSval()))
+	}
+	switch len(parts) {
+	case 0:
+		return "", ""
+	case 1:
+		return "", parts[0]
+	default:
+		return parts[len(parts)-2], parts[len(parts)-1]
+	}
+}
+
+func isAllowedFunction(schema, name string) bool {
+	if !allowedFunctionSchemas[schema] {
+		return false
+	}
+	if allowedFunctions[name] {
+		return true
+	}
+	if schema != "" && schema != "public" {
+		return false
+	}
+	for _, prefix := range allowedFunctionPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// statementText extracts the source text of a parsed statement. A zero
+// statement length means the statement runs to the end of the input.
+func statementText(query string, raw *pganalyze.RawStmt) string {
+	start := int(raw.GetStmtLocation())
+	if raw.GetStmtLen() == 0 {
+		return query[start:]
+	}
+	return query[start : start+int(raw.GetStmtLen())]
+}
+
+// statementType returns a readable name for the statement node, e.g.
+// "CopyStmt" or "VariableSetStmt".
+func statementType(n *pganalyze.Node) string {
+	m := n.ProtoReflect()
+	if fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("node")); fd != nil {
+		return string(fd.Message().Name())
+	}
+	return "unknown"
+}
+
+func toSet(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
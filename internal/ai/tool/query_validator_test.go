@@ -0,0 +1,72 @@
+package tool
+
+import "testing"
+
+func TestValidateReadOnlyQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		// code is the expected rejection code, empty if the query is allowed.
+		code string
+	}{
+		// allowed
+		{"select", `SELECT id, name FROM wallets WHERE user_id = '1'`, ""},
+		{"trailing semicolon", `SELECT 1;`, ""},
+		{"aggregate and group by", `SELECT category, SUM(amount) FROM transactions GROUP BY category ORDER BY 2 DESC`, ""},
+		{"with select", `WITH t AS (SELECT amount FROM transactions) SELECT avg(amount) FROM t`, ""},
+		{"extract", `SELECT EXTRACT(MONTH FROM created_at) FROM transactions`, ""},
+		{"qualified builtin", `SELECT pg_catalog.lower(name) FROM wallets`, ""},
+		{"get procedure", `SELECT * FROM get_monthly_spending('2024-01-01')`, ""},
+		{"public get procedure", `SELECT * FROM public.get_monthly_spending('2024-01-01')`, ""},
+		{"postgis", `SELECT ST_Distance(a.geom, b.geom) FROM places a, places b`, ""},
+
+		// rejected
+		{"syntax error", `SELEC 1`, RejectSyntaxError},
+		{"multiple statements", `SELECT 1; SELECT 2`, RejectMultipleStatement},
+		{"select then delete", `SELECT 1; DELETE FROM wallets`, RejectMultipleStatement},
+		{"copy", `COPY wallets TO STDOUT`, RejectNotSelect},
+		{"copy program", `COPY (SELECT 1) TO PROGRAM 'id'`, RejectNotSelect},
+		{"set", `SET statement_timeout = 0`, RejectNotSelect},
+		{"set role", `SET ROLE postgres`, RejectNotSelect},
+		{"do", `DO $$ BEGIN PERFORM 1; END $$`, RejectNotSelect},
+		{"update", `UPDATE wallets SET balance = 0`, RejectNotSelect},
+		{"insert in with", `WITH x AS (INSERT INTO wallets (id) VALUES (1) RETURNING id) SELECT * FROM x`, RejectDataModifying},
+		{"delete in with", `WITH x AS (DELETE FROM wallets RETURNING id) SELECT * FROM x`, RejectDataModifying},
+		{"update in with", `WITH x AS (UPDATE wallets SET balance = 0 RETURNING id) SELECT * FROM x`, RejectDataModifying},
+		{"for update", `SELECT * FROM wallets FOR UPDATE`, RejectLockingClause},
+		{"for share in subquery", `SELECT * FROM (SELECT * FROM wallets FOR SHARE) w`, RejectLockingClause},
+		{"select into", `SELECT * INTO stolen FROM wallets`, RejectSelectInto},
+		{"pg_terminate_backend", `SELECT pg_terminate_backend(123)`, RejectFunctionNotAllowed},
+		{"pg_sleep", `SELECT pg_sleep(10)`, RejectFunctionNotAllowed},
+		{"qualified pg_terminate_backend", `SELECT pg_catalog.pg_terminate_backend(123)`, RejectFunctionNotAllowed},
+		{"qualified set_config", `SELECT pg_catalog.set_config('role', 'postgres', false)`, RejectFunctionNotAllowed},
+		{"qualified get prefix", `SELECT pg_catalog.get_bit('\x01'::bytea, 0)`, RejectFunctionNotAllowed},
+		{"qualified st prefix", `SELECT pg_catalog.st_anything(1)`, RejectFunctionNotAllowed},
+		{"other schema", `SELECT admin.get_secrets()`, RejectFunctionNotAllowed},
+		{"function in where", `SELECT 1 FROM wallets WHERE pg_read_file('/etc/passwd') IS NOT NULL`, RejectFunctionNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rej := validateReadOnlyQuery(tt.query)
+			switch {
+			case tt.code == "" && rej != nil:
+				t.Fatalf("query rejected: %v", rej)
+			case tt.code != "" && rej == nil:
+				t.Fatalf("query allowed, want %s", tt.code)
+			case tt.code != "" && rej.Code != tt.code:
+				t.Fatalf("rejection = %v, want %s", rej, tt.code)
+			}
+		})
+	}
+}
+
+func TestValidateReadOnlyQueryStatementText(t *testing.T) {
+	stmt, rej := validateReadOnlyQuery("SELECT 1;")
+	if rej != nil {
+		t.Fatalf("query rejected: %v", rej)
+	}
+	if stmt != "SELECT 1" {
+		t.Fatalf("statement = %q, want %q", stmt, "SELECT 1")
+	}
+}
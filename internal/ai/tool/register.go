@@ -4,16 +4,18 @@ import (
 	"github.com/firebase/genkit/go/ai"
 	"github.com/firebase/genkit/go/genkit"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
 )
 
 // RegisterTools defines all database query tools and returns them as a slice
 // that can be passed to ai.WithTools(...) in the flow. Must be called after
-// Genkit initialization.
-func RegisterTools(g *genkit.Genkit, pool *pgxpool.Pool) []ai.Tool {
+// Genkit initialization. cfg bounds the queries executeQuery may run.
+func RegisterTools(g *genkit.Genkit, pool *pgxpool.Pool, cfg config.QueryConfig) []ai.Tool {
 	getTablesTool := registerGetTables(g, pool)
 	getTableDefTool := registerGetTableDefinition(g, pool)
 	getProceduresTool := registerGetProcedures(g, pool)
-	executeQueryTool := registerExecuteQuery(g, pool)
+	executeQueryTool := registerExecuteQuery(g, pool, cfg)
 
 	return []ai.Tool{
 		getTablesTool,
@@ -0,0 +1,119 @@
+// Package auth defines the authenticated caller shared by every layer, from
+// the HTTP middleware down to the AI tools.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// Permissions granted to operators through their roles, or their scopes if
+// allowed.
+const (
+	// PermInspectSessions allows reading the chat sessions of any user.
+	PermInspectSessions = "admin:sessions"
+	// PermManageUsage allows reading usage reports and setting per-user
+	// quotas.
+	PermManageUsage = "admin:usage"
+	// PermManagePrompts allows overriding the built-in prompt templates.
+	PermManagePrompts = "admin:prompts"
+	// PermAll grants every permission.
+	PermAll = "*"
+)
+
+// Principal is the authenticated caller, built from validated token claims.
+type Principal struct {
+	// UserID is the token's "sub" claim in the canonical, lower-case UUID
+	// form returned by ParseUserID. It is never empty.
+	UserID string
+	Roles  []string
+	Scopes []string
+	// TokenID is the token's "jti" claim, if any.
+	TokenID string
+	Plan    string
+	Locale  string
+	// Permissions are granted by the principal's roles and allowed scopes.
+	Permissions []string
+}
+
+// HasRole reports whether the principal has role. It is false for a nil
+// principal.
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && slices.Contains(p.Roles, role)
+}
+
+// HasScope reports whether the principal was granted scope. It is false for
+// a nil principal.
+func (p *Principal) HasScope(scope string) bool {
+	return p != nil && slices.Contains(p.Scopes, scope)
+}
+
+// Can reports whether the principal has permission. It is false for a nil
+// principal.
+func (p *Principal) Can(permission string) bool {
+	return p != nil && (slices.Contains(p.Permissions, permission) || slices.Contains(p.Permissions, PermAll))
+}
+
+// GrantPermissions sets the principal's permissions: those mapped to its
+// roles in rolePermissions, and any of its scopes naming a permission in
+// scopePermissions.
+func (p *Principal) GrantPermissions(rolePermissions map[string][]string, scopePermissions []string) {
+	var perms []string
+	grant := func(perm string) {
+		if !slices.Contains(perms, perm) {
+			perms = append(perms, perm)
+		}
+	}
+	for _, role := range p.Roles {
+		for _, perm := range rolePermissions[role] {
+			grant(perm)
+		}
+	}
+	for _, scope := range p.Scopes {
+		if scope != PermAll && slices.Contains(scopePermissions, scope) {
+			grant(scope)
+		}
+	}
+	p.Permissions = perms
+}
+
+// ParseUserID parses a user ID, such as a token's "sub" claim, which must be
+// a UUID, and returns it in canonical form so user IDs compare equal however
+// the issuer formatted them.
+func ParseUserID(s string) (string, error) {
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("user id %q is not a UUID", s)
+	}
+	return id.String(), nil
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal carried by ctx. It reports false if ctx
+// has none.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	if !ok || p == nil || p.UserID == "" {
+		return nil, false
+	}
+	return p, true
+}
+
+// UserIDFromContext returns the user ID of the principal carried by ctx. It
+// reports false if ctx has none.
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	p, ok := FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return p.UserID, true
+}
@@ -1,7 +1,15 @@
 // Package config handles application configuration from environment variables.
 package config
 
-import "os"
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // Config holds the application configuration values.
 type Config struct {
@@ -9,51 +17,602 @@ type Config struct {
 	QueryDatabaseURL string
 	ChatDatabaseURL  string
 	AI               AIConfig
-	PublicKey    string
+	Chat             ChatConfig
+	Query            QueryConfig
+	Quota            QuotaConfig
+	RateLimit        RateLimitConfig
+	Auth             AuthConfig
+}
+
+// AuthConfig holds the keys that verify JWTs issued by the auth service.
+type AuthConfig struct {
+	// PublicKey is a base64-encoded DER (PKIX) RSA public key. It verifies
+	// tokens whose key is not found in the JWKS, or all tokens if no JWKS
+	// is configured.
+	PublicKey string
+	// JWKSSource is the URL or file path of a JSON Web Key Set. Its keys
+	// are selected by the token's "kid" header.
+	JWKSSource string
+	// JWKSRefreshInterval is how often the JWKS is reloaded. A token with
+	// an unknown "kid" also triggers a reload, at most every
+	// JWKSMinRefreshInterval.
+	JWKSRefreshInterval    time.Duration
+	JWKSMinRefreshInterval time.Duration
+
+	// Issuer and Audience, when set, must match the token's "iss" claim
+	// and be one of its "aud" values.
+	Issuer   string
+	Audience string
+	// Algorithms are the accepted signing algorithms (RS* and PS* only).
+	Algorithms []string
+	// Leeway tolerates clock skew when checking "exp", "nbf" and "iat".
+	Leeway time.Duration
+	// RequireExpiration rejects tokens without an "exp" claim.
+	RequireExpiration bool
+	// VerifyIssuedAt rejects tokens whose "iat" claim is in the future.
+	VerifyIssuedAt bool
+	// MaxTokenAge rejects tokens issued longer ago than this, and tokens
+	// without "iat". Zero disables the check.
+	MaxTokenAge time.Duration
+
+	// RolePermissions maps JWT roles to the permissions they grant ("*"
+	// grants all).
+	RolePermissions map[string][]string
+	// ScopePermissions are the permissions a token may also be granted by
+	// a scope of the same name. It is empty by default, so permissions come
+	// from roles only.
+	ScopePermissions []string
+	// OperatorRoles are the roles allowed to reach the /admin routes, which
+	// then check the permission each route needs. They default to the roles
+	// of RolePermissions.
+	OperatorRoles []string
 }
 
 // AIConfig holds AI/LLM-related configuration.
 type AIConfig struct {
-	// APIKey is the API key for the OpenAI-compatible service.
+	// Providers are the LLM providers models can be served from.
+	Providers []ProviderConfig
+	// Models maps logical model names (ModelDefault, ModelChat, ...) to a
+	// fallback chain of "provider/model" references, where provider is a
+	// Providers name. The first model is the primary one. A logical name
+	// without an entry uses ModelDefault.
+	Models map[string][]string
+	// Retry controls retries of failed model calls.
+	Retry RetryConfig
+	// History bounds the conversation context sent to the model.
+	History HistoryConfig
+}
+
+// RetryConfig controls how failed model calls are retried before falling
+// back to the next model of a chain.
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts per model for retryable errors
+	// (rate limits, server errors, timeouts).
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry; it doubles with
+	// every further retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries.
+	MaxBackoff time.Duration
+}
+
+// Logical model names used by the application.
+const (
+	ModelDefault = "default"
+	ModelChat    = "chat"
+	ModelTitle   = "title"
+	ModelSummary = "summary"
+	// ModelFast and ModelAccurate are the model tiers clients may request
+	// per turn instead of ModelChat.
+	ModelFast     = "fast"
+	ModelAccurate = "accurate"
+)
+
+// Model returns the primary "provider/model" reference of a logical model
+// name.
+func (c AIConfig) Model(logical string) string {
+	if chain := c.ModelChain(logical); len(chain) > 0 {
+		return chain[0]
+	}
+	return ""
+}
+
+// ModelChain returns the fallback chain of a logical model name.
+func (c AIConfig) ModelChain(logical string) []string {
+	if chain, ok := c.Models[logical]; ok {
+		return chain
+	}
+	return c.Models[ModelDefault]
+}
+
+// Provider types supported in ProviderConfig.Type.
+const (
+	ProviderOpenAI    = "openai"
+	ProviderOllama    = "ollama"
+	ProviderAnthropic = "anthropic"
+	ProviderGoogleAI  = "googleai"
+)
+
+// ProviderConfig configures one LLM provider.
+type ProviderConfig struct {
+	// Name identifies the provider in model references ("name/model").
+	// Only OpenAI-compatible providers may be named freely; the other types
+	// must be named after their type.
+	Name string
+	// Type is one of ProviderOpenAI (any OpenAI-compatible API),
+	// ProviderOllama, ProviderAnthropic or ProviderGoogleAI.
+	Type string
+	// APIKey authenticates with the provider. Unused by Ollama.
 	APIKey string
-	// BaseURL is the base URL of the OpenAI-compatible API endpoint
-	// (e.g. "https://api.openai.com/v1").
+	// BaseURL overrides the provider's endpoint (for Ollama, the server
+	// address). Empty uses the provider's default.
 	BaseURL string
-	// Model is the model identifier in "provider/model" format
-	// (e.g. "openai-compat/gpt-4o-mini").
-	Model string
+}
+
+// HistoryConfig controls how much conversation history is sent to the model.
+// Turns outside the window are folded into a model-generated running summary.
+type HistoryConfig struct {
+	// MaxTurns is the number of most recent turns (user message plus the
+	// replies to it) kept verbatim. Zero disables the turn limit.
+	MaxTurns int
+	// MaxTokens is the estimated token budget for the system prompt,
+	// summary and verbatim history. Zero disables the token budget.
+	MaxTokens int
+	// MaxToolOutputBytes compacts tool outputs larger than this (as JSON)
+	// before they are saved in the session. Zero keeps outputs unchanged.
+	MaxToolOutputBytes int
+}
+
+// ChatConfig holds settings for background chat runs.
+type ChatConfig struct {
+	// RunTimeout bounds how long a single chat turn may generate.
+	RunTimeout time.Duration
+	// RunRetention is how long a finished run's events are kept so that
+	// reconnecting clients can replay them.
+	RunRetention time.Duration
+	// BusySession decides what happens to a turn sent while another turn of
+	// the same session is running: BusySessionQueue or BusySessionReject.
+	BusySession string
+	// Generation bounds the generation parameters clients may set per turn.
+	Generation GenerationConfig
+}
+
+// GenerationConfig bounds the generation parameters clients may request for
+// a turn.
+type GenerationConfig struct {
+	// Default applies to users with none of the roles in Roles.
+	Default GenerationLimits
+	// Roles holds the limits of JWT roles. A user with several of these
+	// roles gets the most permissive limits among them.
+	Roles map[string]GenerationLimits
+}
+
+// GenerationLimits are upper bounds for client-requested generation
+// parameters. Requested values above them are clamped.
+type GenerationLimits struct {
+	MaxTemperature  float64
+	MaxOutputTokens int
+	// Tiers lists the model tiers (ModelFast, ModelAccurate) that may be
+	// requested.
+	Tiers []string
+}
 
+// Values of ChatConfig.BusySession.
+const (
+	// BusySessionQueue holds the new turn until the running one finishes
+	// and then streams it.
+	BusySessionQueue = "queue"
+	// BusySessionReject refuses the new turn with 409 Conflict.
+	BusySessionReject = "reject"
+)
+
+// QuotaConfig holds the token quotas of users. Usage is counted in total
+// tokens per UTC calendar day and month.
+type QuotaConfig struct {
+	// Default applies to users without a plan, or whose plan is not in
+	// Plans.
+	Default QuotaLimits
+	// Plans holds the quotas of the plans named by the JWT "plan" claim.
+	Plans map[string]QuotaLimits
+}
+
+// QuotaLimits are token quotas. Zero means unlimited.
+type QuotaLimits struct {
+	DailyTokens   int64
+	MonthlyTokens int64
+}
+
+// RateLimitConfig holds the request rate limits. Clients are identified by
+// their JWT subject, or by their IP address when unauthenticated.
+type RateLimitConfig struct {
+	// Store is RateLimitStoreMemory (per replica) or RateLimitStorePostgres
+	// (shared by all replicas through the chat database).
+	Store string
+	// TrustProxy takes the client IP from the X-Forwarded-For or X-Real-IP
+	// header. Only enable it behind a proxy that sets these headers.
+	TrustProxy bool
+	// Requests limits every request of a client.
+	Requests RateLimit
+	// ChatTurns limits the chat turns a client may start.
+	ChatTurns RateLimit
+	// MaxStreams is the number of event streams a client may hold open at
+	// once. Zero disables the limit.
+	MaxStreams int
+	// StreamLease bounds how long a stream slot is held in the Postgres
+	// store, so slots of a replica that died are eventually freed. It must
+	// exceed the longest stream (ChatConfig.RunTimeout).
+	StreamLease time.Duration
+}
+
+// RateLimit is a token bucket: clients may send Burst requests at once, and
+// PerMinute requests per minute on average. A zero PerMinute disables it.
+type RateLimit struct {
+	PerMinute float64
+	Burst     int
+}
+
+// Values of RateLimitConfig.Store.
+const (
+	RateLimitStoreMemory   = "memory"
+	RateLimitStorePostgres = "postgres"
+)
+
+// QueryConfig holds the limits applied to SQL queries issued by AI tools.
+type QueryConfig struct {
+	// StatementTimeout aborts any tool query running longer than this.
+	StatementTimeout time.Duration
+	// LockTimeout aborts a tool query waiting longer than this for a lock.
+	LockTimeout time.Duration
+	// IdleInTransactionTimeout terminates a tool transaction left idle
+	// longer than this.
+	IdleInTransactionTimeout time.Duration
+	// MaxRows is the maximum number of rows returned to the model. It is
+	// also pushed down to the server as a LIMIT.
+	MaxRows int
+	// MaxResponseBytes is the maximum JSON size of the rows returned to the
+	// model.
+	MaxResponseBytes int
+	// Role, when set, is the restricted Postgres role tool queries switch to
+	// (SET LOCAL ROLE) so row-level security policies apply to them.
+	Role string
 }
 
 // Load reads configuration from environment variables and returns a Config.
-// It falls back to sensible defaults when variables are not set.
-func Load() *Config {
+// It falls back to sensible defaults when variables are not set, and fails
+// when a set value is out of range.
+func Load() (*Config, error) {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	baseURL := os.Getenv("OPENAI_BASE_URL")
-	if baseURL == "" {
-		baseURL = "https://api.openai.com/v1"
+	providers, models := loadProviders()
+
+	algorithms := splitList(os.Getenv("JWT_ALGORITHMS"))
+	if len(algorithms) == 0 {
+		algorithms = []string{"RS256", "PS256"}
 	}
 
-	model := os.Getenv("AI_MODEL")
-	if model == "" {
-		model = "gpt-4o-mini"
+	rolePermissions := loadRolePermissions()
+	operatorRoles := splitList(os.Getenv("AUTH_OPERATOR_ROLES"))
+	if len(operatorRoles) == 0 {
+		operatorRoles = slices.Sorted(maps.Keys(rolePermissions))
 	}
 
-	publicKey := os.Getenv("PUBLIC_KEY")
+	busySession := os.Getenv("CHAT_BUSY_SESSION")
+	if busySession != BusySessionReject {
+		busySession = BusySessionQueue
+	}
 
-	return &Config{
+	query := QueryConfig{
+		StatementTimeout:         getEnvDuration("QUERY_STATEMENT_TIMEOUT", 5*time.Second),
+		LockTimeout:              getEnvDuration("QUERY_LOCK_TIMEOUT", time.Second),
+		IdleInTransactionTimeout: getEnvDuration("QUERY_IDLE_IN_TRANSACTION_TIMEOUT", 10*time.Second),
+		MaxRows:                  getEnvInt("QUERY_MAX_ROWS", 100),
+		MaxResponseBytes:         getEnvInt("QUERY_MAX_RESPONSE_BYTES", 32*1024),
+		Role:                     os.Getenv("QUERY_DB_ROLE"),
+	}
+
+	cfg := &Config{
 		Port:             port,
 		QueryDatabaseURL: os.Getenv("QUERY_DATABASE_URL"),
 		ChatDatabaseURL:  os.Getenv("CHAT_DATABASE_URL"),
 		AI: AIConfig{
+			Providers: providers,
+			Models:    models,
+			Retry: RetryConfig{
+				MaxAttempts:    getEnvInt("AI_RETRY_MAX_ATTEMPTS", 3),
+				InitialBackoff: getEnvDuration("AI_RETRY_INITIAL_BACKOFF", 500*time.Millisecond),
+				MaxBackoff:     getEnvDuration("AI_RETRY_MAX_BACKOFF", 5*time.Second),
+			},
+			History: HistoryConfig{
+				MaxTurns:  getEnvInt("HISTORY_MAX_TURNS", 10),
+				MaxTokens: getEnvInt("HISTORY_MAX_TOKENS", 12000),
+
+				MaxToolOutputBytes: getEnvInt("HISTORY_MAX_TOOL_OUTPUT_BYTES", 4096),
+			},
+		},
+		Chat: ChatConfig{
+			RunTimeout:   getEnvDuration("CHAT_RUN_TIMEOUT", 5*time.Minute),
+			RunRetention: getEnvDuration("CHAT_RUN_RETENTION", 5*time.Minute),
+			BusySession:  busySession,
+			Generation:   loadGeneration(),
+		},
+		Query:     query,
+		Quota:     loadQuota(),
+		RateLimit: loadRateLimit(),
+		Auth: AuthConfig{
+			PublicKey:              os.Getenv("PUBLIC_KEY"),
+			JWKSSource:             os.Getenv("JWKS_SOURCE"),
+			JWKSRefreshInterval:    getEnvDuration("JWKS_REFRESH_INTERVAL", 15*time.Minute),
+			JWKSMinRefreshInterval: getEnvDuration("JWKS_MIN_REFRESH_INTERVAL", time.Minute),
+			Issuer:                 os.Getenv("JWT_ISSUER"),
+			Audience:               os.Getenv("JWT_AUDIENCE"),
+			Algorithms:             algorithms,
+			Leeway:                 getEnvDuration("JWT_LEEWAY", 30*time.Second),
+			RequireExpiration:      getEnvBool("JWT_REQUIRE_EXP", true),
+			VerifyIssuedAt:         getEnvBool("JWT_VERIFY_IAT", false),
+			MaxTokenAge:            getEnvDuration("JWT_MAX_TOKEN_AGE", 0),
+			RolePermissions:        rolePermissions,
+			ScopePermissions:       splitList(os.Getenv("AUTH_SCOPE_PERMISSIONS")),
+			OperatorRoles:          operatorRoles,
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate checks the settings whose out of range values would break the
+// application rather than merely disable a feature.
+func (c *Config) validate() error {
+	if c.Query.MaxRows <= 0 {
+		return fmt.Errorf("QUERY_MAX_ROWS must be positive, got %d", c.Query.MaxRows)
+	}
+	if c.Query.MaxResponseBytes <= 0 {
+		return fmt.Errorf("QUERY_MAX_RESPONSE_BYTES must be positive, got %d", c.Query.MaxResponseBytes)
+	}
+	// Postgres disables a timeout set to zero, which would lift the guard.
+	if c.Query.StatementTimeout <= 0 {
+		return fmt.Errorf("QUERY_STATEMENT_TIMEOUT must be positive, got %s", c.Query.StatementTimeout)
+	}
+	if c.Query.LockTimeout <= 0 {
+		return fmt.Errorf("QUERY_LOCK_TIMEOUT must be positive, got %s", c.Query.LockTimeout)
+	}
+	if c.Query.IdleInTransactionTimeout <= 0 {
+		return fmt.Errorf("QUERY_IDLE_IN_TRANSACTION_TIMEOUT must be positive, got %s", c.Query.IdleInTransactionTimeout)
+	}
+	if c.Auth.JWKSSource != "" {
+		if c.Auth.JWKSRefreshInterval <= 0 {
+			return fmt.Errorf("JWKS_REFRESH_INTERVAL must be positive, got %s", c.Auth.JWKSRefreshInterval)
+		}
+		if c.Auth.JWKSMinRefreshInterval <= 0 {
+			return fmt.Errorf("JWKS_MIN_REFRESH_INTERVAL must be positive, got %s", c.Auth.JWKSMinRefreshInterval)
+		}
+	}
+	if slices.Contains(c.Auth.ScopePermissions, "*") {
+		return fmt.Errorf("AUTH_SCOPE_PERMISSIONS must list permissions, not %q", "*")
+	}
+	return nil
+}
+
+// loadProviders reads the LLM providers and logical models.
+//
+// AI_PROVIDERS lists provider names; each is configured with
+// AI_PROVIDER_<NAME>_TYPE, _API_KEY and _BASE_URL. The type defaults to the
+// name for "ollama", "anthropic" and "googleai" and to "openai" otherwise.
+// AI_MODELS maps logical names to models, e.g.
+// "default=openai/gpt-4o-mini,title=ollama/llama3.2"; a model may be a
+// fallback chain separated by "|", e.g. "chat=openai/gpt-4o|openai/gpt-4o-mini".
+//
+// Without AI_PROVIDERS, a single OpenAI-compatible provider named
+// "openai-compat" is configured from OPENAI_API_KEY and OPENAI_BASE_URL, and
+// AI_MODEL is its default model.
+func loadProviders() ([]ProviderConfig, map[string][]string) {
+	var providers []ProviderConfig
+	for _, name := range splitList(os.Getenv("AI_PROVIDERS")) {
+		prefix := "AI_PROVIDER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		typ := os.Getenv(prefix + "TYPE")
+		if typ == "" {
+			typ = ProviderOpenAI
+			switch name {
+			case ProviderOllama, ProviderAnthropic, ProviderGoogleAI:
+				typ = name
+			}
+		}
+		providers = append(providers, ProviderConfig{
+			Name:    name,
+			Type:    typ,
+			APIKey:  os.Getenv(prefix + "API_KEY"),
+			BaseURL: os.Getenv(prefix + "BASE_URL"),
+		})
+	}
+
+	if len(providers) == 0 {
+		baseURL := os.Getenv("OPENAI_BASE_URL")
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		providers = []ProviderConfig{{
+			Name:    "openai-compat",
+			Type:    ProviderOpenAI,
 			APIKey:  os.Getenv("OPENAI_API_KEY"),
 			BaseURL: baseURL,
-			Model:   model,
+		}}
+	}
+
+	models := make(map[string][]string)
+	for _, entry := range splitList(os.Getenv("AI_MODELS")) {
+		logical, refs, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		var chain []string
+		for _, ref := range strings.Split(refs, "|") {
+			if ref = strings.TrimSpace(ref); ref != "" {
+				chain = append(chain, ref)
+			}
+		}
+		models[strings.TrimSpace(logical)] = chain
+	}
+	if _, ok := models[ModelDefault]; !ok {
+		model := os.Getenv("AI_MODEL")
+		if model == "" {
+			model = "gpt-4o-mini"
+		}
+		models[ModelDefault] = []string{providers[0].Name + "/" + model}
+	}
+
+	return providers, models
+}
+
+// loadGeneration reads the generation limits. GENERATION_MAX_TEMPERATURE,
+// GENERATION_MAX_OUTPUT_TOKENS and GENERATION_TIERS set the default limits;
+// GENERATION_ROLES lists roles whose limits are overridden with
+// GENERATION_ROLE_<ROLE>_MAX_TEMPERATURE, _MAX_OUTPUT_TOKENS and _TIERS.
+func loadGeneration() GenerationConfig {
+	def := GenerationLimits{
+		MaxTemperature:  getEnvFloat("GENERATION_MAX_TEMPERATURE", 1),
+		MaxOutputTokens: getEnvInt("GENERATION_MAX_OUTPUT_TOKENS", 2048),
+		Tiers:           []string{ModelFast},
+	}
+	if v, ok := os.LookupEnv("GENERATION_TIERS"); ok {
+		def.Tiers = splitList(v)
+	}
+
+	roles := make(map[string]GenerationLimits)
+	for _, role := range splitList(os.Getenv("GENERATION_ROLES")) {
+		prefix := "GENERATION_ROLE_" + strings.ToUpper(strings.ReplaceAll(role, "-", "_")) + "_"
+		limits := GenerationLimits{
+			MaxTemperature:  getEnvFloat(prefix+"MAX_TEMPERATURE", def.MaxTemperature),
+			MaxOutputTokens: getEnvInt(prefix+"MAX_OUTPUT_TOKENS", def.MaxOutputTokens),
+			Tiers:           def.Tiers,
+		}
+		if v, ok := os.LookupEnv(prefix + "TIERS"); ok {
+			limits.Tiers = splitList(v)
+		}
+		roles[role] = limits
+	}
+
+	return GenerationConfig{Default: def, Roles: roles}
+}
+
+// loadQuota reads the token quotas. QUOTA_DAILY_TOKENS and
+// QUOTA_MONTHLY_TOKENS set the default quota; QUOTA_PLANS lists plans whose
+// quotas are overridden with QUOTA_PLAN_<PLAN>_DAILY_TOKENS and
+// _MONTHLY_TOKENS.
+func loadQuota() QuotaConfig {
+	def := QuotaLimits{
+		DailyTokens:   int64(getEnvInt("QUOTA_DAILY_TOKENS", 200000)),
+		MonthlyTokens: int64(getEnvInt("QUOTA_MONTHLY_TOKENS", 3000000)),
+	}
+
+	plans := make(map[string]QuotaLimits)
+	for _, plan := range splitList(os.Getenv("QUOTA_PLANS")) {
+		prefix := "QUOTA_PLAN_" + strings.ToUpper(strings.ReplaceAll(plan, "-", "_")) + "_"
+		plans[plan] = QuotaLimits{
+			DailyTokens:   int64(getEnvInt(prefix+"DAILY_TOKENS", int(def.DailyTokens))),
+			MonthlyTokens: int64(getEnvInt(prefix+"MONTHLY_TOKENS", int(def.MonthlyTokens))),
+		}
+	}
+
+	return QuotaConfig{Default: def, Plans: plans}
+}
+
+// loadRolePermissions reads AUTH_ROLE_PERMISSIONS, mapping roles to
+// "|"-separated permissions, e.g. "admin=*,support=admin:sessions|admin:usage".
+// By default the "admin" role is granted every permission.
+func loadRolePermissions() map[string][]string {
+	v, ok := os.LookupEnv("AUTH_ROLE_PERMISSIONS")
+	if !ok {
+		return map[string][]string{"admin": {"*"}}
+	}
+
+	perms := make(map[string][]string)
+	for _, entry := range splitList(v) {
+		role, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		for _, perm := range strings.Split(list, "|") {
+			if perm = strings.TrimSpace(perm); perm != "" {
+				perms[strings.TrimSpace(role)] = append(perms[strings.TrimSpace(role)], perm)
+			}
+		}
+	}
+	return perms
+}
+
+// loadRateLimit reads the rate limits from the RATE_LIMIT_* variables.
+func loadRateLimit() RateLimitConfig {
+	store := os.Getenv("RATE_LIMIT_STORE")
+	if store != RateLimitStorePostgres {
+		store = RateLimitStoreMemory
+	}
+	return RateLimitConfig{
+		Store:      store,
+		TrustProxy: getEnvBool("RATE_LIMIT_TRUST_PROXY", false),
+		Requests: RateLimit{
+			PerMinute: getEnvFloat("RATE_LIMIT_REQUESTS_PER_MINUTE", 120),
+			Burst:     getEnvInt("RATE_LIMIT_REQUESTS_BURST", 60),
+		},
+		ChatTurns: RateLimit{
+			PerMinute: getEnvFloat("RATE_LIMIT_CHAT_PER_MINUTE", 10),
+			Burst:     getEnvInt("RATE_LIMIT_CHAT_BURST", 5),
 		},
-		PublicKey: publicKey,
+		MaxStreams:  getEnvInt("RATE_LIMIT_MAX_STREAMS", 3),
+		StreamLease: getEnvDuration("RATE_LIMIT_STREAM_LEASE", 10*time.Minute),
+	}
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvBool parses a boolean from the environment, returning def when the
+// variable is unset or invalid.
+func getEnvBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvDuration parses a time.Duration (e.g. "5s") from the environment,
+// returning def when the variable is unset or invalid.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvFloat parses a float from the environment, returning def when the
+// variable is unset or invalid.
+func getEnvFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvInt parses an integer from the environment, returning def when the
+// variable is unset or invalid.
+func getEnvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
 	}
+	return v
 }
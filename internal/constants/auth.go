@@ -1,3 +0,0 @@
-package constants
-
-type UserContextKey struct{}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/service"
+)
+
+const (
+	// reportDateLayout is the format of the usage report date range.
+	reportDateLayout = "2006-01-02"
+	maxPromptBytes   = 64 * 1024
+)
+
+// SetPromptRequest is the expected JSON body for PUT /admin/prompts/{name}.
+type SetPromptRequest struct {
+	Template string `json:"template"`
+}
+
+// AdminHandler handles the operator endpoints under /admin. Routes must be
+// guarded with middleware.RequirePermission.
+type AdminHandler struct {
+	adminService service.AdminService
+}
+
+// NewAdminHandler creates a new AdminHandler with the given AdminService.
+func NewAdminHandler(as service.AdminService) *AdminHandler {
+	return &AdminHandler{adminService: as}
+}
+
+// ListSessions handles GET /admin/sessions. It returns the sessions of every
+// user, or of the user given by the "userId" query parameter, newest first,
+// paginated with "limit" and "offset".
+func (h *AdminHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", defaultSessionPageSize)
+	if err != nil || limit < 1 || limit > maxSessionPageSize {
+		writeError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+		return
+	}
+
+	list, err := h.adminService.ListSessions(r.Context(), r.URL.Query().Get("userId"), limit, offset)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// GetSession handles GET /admin/sessions/{id} and returns the messages of a
+// session of any user.
+func (h *AdminHandler) GetSession(w http.ResponseWriter, r *http.Request) {
+	detail, err := h.adminService.GetSession(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// GetUsage handles GET /admin/usage. It reports the token usage per user,
+// optionally of the user given by "userId", between the "from" and "to"
+// dates (YYYY-MM-DD, UTC, both inclusive). The range defaults to the current
+// month up to today.
+func (h *AdminHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(reportDateLayout, v); err != nil {
+			writeError(w, http.StatusBadRequest, "from must be a date (YYYY-MM-DD)")
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(reportDateLayout, v); err != nil {
+			writeError(w, http.StatusBadRequest, "to must be a date (YYYY-MM-DD)")
+			return
+		}
+	}
+	if to.Before(from) {
+		writeError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+
+	report, err := h.adminService.UsageByUser(r.Context(), r.URL.Query().Get("userId"), from, to.AddDate(0, 0, 1))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load usage")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// SetUserQuota handles PUT /admin/users/{id}/quota. It overrides the plan
+// quotas of a user; null limits restore the plan's.
+func (h *AdminHandler) SetUserQuota(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(userID); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	var req service.UserQuota
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if (req.DailyTokens != nil && *req.DailyTokens < 0) || (req.MonthlyTokens != nil && *req.MonthlyTokens < 0) {
+		writeError(w, http.StatusBadRequest, "quotas must be non-negative")
+		return
+	}
+
+	if err := h.adminService.SetUserQuota(r.Context(), userID, req); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to set quota")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListPrompts handles GET /admin/prompts and returns every managed prompt.
+func (h *AdminHandler) ListPrompts(w http.ResponseWriter, r *http.Request) {
+	prompts, err := h.adminService.ListPrompts(r.Context())
+	if err != nil {
+		writePromptError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, prompts)
+}
+
+// GetPrompt handles GET /admin/prompts/{name}.
+func (h *AdminHandler) GetPrompt(w http.ResponseWriter, r *http.Request) {
+	prompt, err := h.adminService.GetPrompt(r.Context(), chi.URLParam(r, "name"))
+	if err != nil {
+		writePromptError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, prompt)
+}
+
+// SetPrompt handles PUT /admin/prompts/{name}. The template uses Go template
+// syntax with the fields of flow.PromptData.
+func (h *AdminHandler) SetPrompt(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principal(w, r)
+	if !ok {
+		return
+	}
+
+	var req SetPromptRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxPromptBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.Template) == "" {
+		writeError(w, http.StatusBadRequest, "template is required")
+		return
+	}
+	if len(req.Template) > maxPromptBytes {
+		writeError(w, http.StatusBadRequest, "template must be at most 64 KiB")
+		return
+	}
+
+	prompt, err := h.adminService.SetPrompt(r.Context(), chi.URLParam(r, "name"), req.Template, caller.UserID)
+	if err != nil {
+		writePromptError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, prompt)
+}
+
+// ResetPrompt handles DELETE /admin/prompts/{name}. It restores the built-in
+// template and returns it.
+func (h *AdminHandler) ResetPrompt(w http.ResponseWriter, r *http.Request) {
+	prompt, err := h.adminService.ResetPrompt(r.Context(), chi.URLParam(r, "name"))
+	if err != nil {
+		writePromptError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, prompt)
+}
+
+// writePromptError maps prompt management errors to HTTP status codes.
+func writePromptError(w http.ResponseWriter, err error) {
+	var invalid *service.InvalidPromptError
+	switch {
+	case errors.Is(err, service.ErrPromptNotFound):
+		writeError(w, http.StatusNotFound, "prompt not found")
+	case errors.As(err, &invalid):
+		writeError(w, http.StatusBadRequest, invalid.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, "internal server error")
+	}
+}
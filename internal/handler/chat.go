@@ -1,11 +1,19 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/FPT-OJT/minstant-ai.git/internal/middleware"
+	"github.com/go-chi/chi/v5"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/ai/flow"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+	"github.com/FPT-OJT/minstant-ai.git/internal/repository"
 	"github.com/FPT-OJT/minstant-ai.git/internal/service"
 )
 
@@ -16,8 +24,24 @@ type ChatRequest struct {
 	FullName  *string  `json:"fullName"`
 	Lat       *float64 `json:"lat"`
 	Long      *float64 `json:"long"`
+	// Config optionally tunes generation for this turn. Values above the
+	// limits of the caller's roles are clamped.
+	Config *ChatRequestConfig `json:"config"`
+}
+
+// ChatRequestConfig holds the optional generation settings of a ChatRequest.
+type ChatRequestConfig struct {
+	// Temperature must be between 0 and maxTemperature.
+	Temperature *float64 `json:"temperature"`
+	// MaxOutputTokens must be positive.
+	MaxOutputTokens *int `json:"maxOutputTokens"`
+	// Tier is "fast" or "accurate"; empty uses the default chat model.
+	Tier string `json:"tier"`
 }
 
+// maxTemperature is the highest temperature accepted from clients.
+const maxTemperature = 2.0
+
 // ChatHandler handles chat-related HTTP requests.
 type ChatHandler struct {
 	chatService service.ChatService
@@ -29,75 +53,275 @@ func NewChatHandler(cs service.ChatService) *ChatHandler {
 }
 
 // HandleChat processes POST /api/chat. It validates the request, calls the
-// ChatService to generate a streaming response, and writes each chunk back
-// to the client as a Server-Sent Event.
+// ChatService to generate a streaming response, and writes each event back
+// to the client as a typed Server-Sent Event (see sseProtocolVersion). A
+// session owned by another user is refused with 403 Forbidden before the
+// turn starts.
 func (h *ChatHandler) HandleChat(w http.ResponseWriter, r *http.Request) {
-	var req ChatRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "invalid request body",
-		})
+	chatInput, ok := decodeChatRequest(w, r)
+	if !ok {
 		return
 	}
 
-	if req.ChatInput == "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "message is required",
-		})
+	run, err := h.chatService.StartRun(r.Context(), chatInput)
+	if err != nil {
+		writeStartRunError(w, err)
 		return
 	}
 
-	if req.SessionID == "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "sessionId is required",
-		})
+	h.streamRun(w, r, run, 0)
+}
+
+// HandleRunStream processes GET /chat/runs/{id}/stream. It resumes the event
+// stream of a run after the event ID given in the Last-Event-ID header (or
+// the lastEventId query parameter), replaying missed events before
+// continuing live.
+func (h *ChatHandler) HandleRunStream(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principal(w, r)
+	if !ok {
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	afterID := 0
+	if lastEventID != "" {
+		id, err := strconv.Atoi(lastEventID)
+		if err != nil || id < 0 {
+			writeError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+			return
+		}
+		afterID = id
+	}
+
+	run, err := h.chatService.GetRun(chi.URLParam(r, "id"), caller.UserID)
+	if err != nil {
+		if errors.Is(err, service.ErrRunNotFound) {
+			writeError(w, http.StatusNotFound, "run not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.streamRun(w, r, run, afterID)
+}
+
+// CancelRunResponse is the JSON body returned by POST /chat/runs/{id}/cancel.
+type CancelRunResponse struct {
+	RunID     string `json:"runId"`
+	SessionID string `json:"sessionId"`
+}
+
+// HandleCancelRun processes POST /chat/runs/{id}/cancel. The ID may be a run
+// ID or the ID of a session with a generation in flight. Cancellation is
+// asynchronous: the partial answer is saved and connected streams receive a
+// final cancelled event.
+func (h *ChatHandler) HandleCancelRun(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principal(w, r)
+	if !ok {
 		return
 	}
 
-	// Set SSE headers.
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(http.StatusOK)
-	userId := middleware.ExtractUserID(r)
-	chatInput := service.ChatInput{
-		ChatInput: req.ChatInput,
-		SessionID: req.SessionID,
-		FullName:  req.FullName,
-		Lat:       req.Lat,
-		Long:      req.Long,
-		UserId:    userId,
+	run, err := h.chatService.CancelRun(chi.URLParam(r, "id"), caller.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrRunNotFound):
+			writeError(w, http.StatusNotFound, "run not found")
+		case errors.Is(err, service.ErrRunFinished):
+			writeError(w, http.StatusConflict, "run already finished")
+		default:
+			writeError(w, http.StatusInternalServerError, "internal server error")
+		}
+		return
 	}
 
-	chunks, errCh := h.chatService.GenerateResponse(r.Context(), chatInput)
+	writeJSON(w, http.StatusAccepted, CancelRunResponse{RunID: run.ID, SessionID: run.SessionID})
+}
 
+// streamRun writes the events of run with an ID greater than afterID as SSE
+// until the terminal event or until the client disconnects. Disconnecting
+// does not stop the run.
+func (h *ChatHandler) streamRun(w http.ResponseWriter, r *http.Request, run *service.Run, afterID int) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming not supported", http.StatusInternalServerError)
 		return
 	}
 
-	for chunk := range chunks {
-		if _, err := fmt.Fprintf(w, "data: %s\n\n", chunk); err != nil {
+	events := run.Subscribe(r.Context(), afterID)
+
+	// Wait for the first event before committing to a streaming response.
+	// StartRun refuses foreign sessions, but a session created by another
+	// user since then is only found by the flow.
+	first, ok := <-events
+	if !ok {
+		return
+	}
+	if first.Type == service.EventError {
+		var forbidden *repository.SessionForbiddenError
+		if errors.As(first.Err, &forbidden) {
+			writeError(w, http.StatusForbidden, "session belongs to another user")
 			return
 		}
-		flusher.Flush()
 	}
 
-	// Check if the generation ended with an error.
-	if err := <-errCh; err != nil {
-		fmt.Fprintf(w, "data: [ERROR] %s\n\n", err.Error())
-		flusher.Flush()
+	sse := startSSE(w, flusher, run.ID)
+	if done, err := writeChatEvent(sse, first); done || err != nil {
 		return
 	}
 
-	// Signal completion.
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if done, err := writeChatEvent(sse, ev); done || err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := sse.comment("heartbeat"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeStartRunError writes the response for a turn that could not start.
+func writeStartRunError(w http.ResponseWriter, err error) {
+	var (
+		quota     *service.QuotaExceededError
+		forbidden *repository.SessionForbiddenError
+	)
+	switch {
+	case errors.As(err, &forbidden):
+		writeError(w, http.StatusForbidden, "session belongs to another user")
+	case errors.As(err, &quota):
+		retryAfter := int(math.Ceil(time.Until(quota.ResetsAt).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		writeError(w, http.StatusTooManyRequests, quota.Period+" token quota exceeded")
+	case errors.Is(err, service.ErrSessionBusy):
+		writeError(w, http.StatusConflict, "session is already generating a response")
+	case errors.Is(err, service.ErrTierNotAllowed):
+		writeError(w, http.StatusForbidden, "model tier not allowed")
+	default:
+		writeError(w, http.StatusInternalServerError, "failed to start chat")
+	}
+}
+
+// runError is the client-facing description of a failed run. Its message is
+// fixed per code so that provider, database and SQL errors are not leaked.
+type runError struct {
+	status  int
+	code    string
+	message string
+}
+
+// classifyRunError maps the error of a failed run to a runError.
+func classifyRunError(err error) runError {
+	var (
+		quota       *service.QuotaExceededError
+		forbidden   *repository.SessionForbiddenError
+		unavailable *flow.UnavailableError
+		mismatch    *flow.UserMismatchError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return runError{http.StatusGatewayTimeout, errCodeTimeout, "generation timed out"}
+	case errors.As(err, &unavailable):
+		return runError{http.StatusBadGateway, errCodeProviderUnavailable, "the model provider is unavailable, try again later"}
+	case errors.As(err, &quota):
+		return runError{http.StatusTooManyRequests, errCodeQuotaExceeded, "token quota exceeded"}
+	case errors.As(err, &forbidden):
+		return runError{http.StatusForbidden, errCodeSessionForbidden, "session belongs to another user"}
+	case errors.As(err, &mismatch):
+		return runError{http.StatusForbidden, errCodeForbidden, "the turn must be run as the authenticated user"}
+	case errors.Is(err, service.ErrSessionBusy):
+		return runError{http.StatusConflict, errCodeSessionBusy, "session is already generating a response"}
+	default:
+		return runError{http.StatusInternalServerError, errCodeGenerationFailed, "failed to generate a response"}
+	}
+}
+
+// decodeChatRequest decodes and validates a ChatRequest body, writing a 400
+// response and returning false if it is invalid. The caller always comes
+// from the verified token, never from the body.
+func decodeChatRequest(w http.ResponseWriter, r *http.Request) (service.ChatInput, bool) {
+	caller, ok := principal(w, r)
+	if !ok {
+		return service.ChatInput{}, false
+	}
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return service.ChatInput{}, false
+	}
+
+	if req.ChatInput == "" {
+		writeError(w, http.StatusBadRequest, "message is required")
+		return service.ChatInput{}, false
+	}
+
+	if req.SessionID == "" {
+		writeError(w, http.StatusBadRequest, "sessionId is required")
+		return service.ChatInput{}, false
+	}
+
+	var generation service.GenerationOptions
+	if c := req.Config; c != nil {
+		if c.Temperature != nil && (*c.Temperature < 0 || *c.Temperature > maxTemperature) {
+			writeError(w, http.StatusBadRequest, "config.temperature must be between 0 and 2")
+			return service.ChatInput{}, false
+		}
+		if c.MaxOutputTokens != nil && *c.MaxOutputTokens < 1 {
+			writeError(w, http.StatusBadRequest, "config.maxOutputTokens must be positive")
+			return service.ChatInput{}, false
+		}
+		if c.Tier != "" && c.Tier != config.ModelFast && c.Tier != config.ModelAccurate {
+			writeError(w, http.StatusBadRequest, `config.tier must be "fast" or "accurate"`)
+			return service.ChatInput{}, false
+		}
+		generation = service.GenerationOptions{
+			Temperature:     c.Temperature,
+			MaxOutputTokens: c.MaxOutputTokens,
+			Tier:            c.Tier,
+		}
+	}
+
+	return service.ChatInput{
+		ChatInput:  req.ChatInput,
+		SessionID:  req.SessionID,
+		FullName:   req.FullName,
+		Lat:        req.Lat,
+		Long:       req.Long,
+		Principal:  caller,
+		Generation: generation,
+	}, true
+}
+
+// writeChatEvent writes ev to the stream and reports whether it was the
+// terminal event of the turn.
+func writeChatEvent(sse *sseWriter, ev service.ChatEvent) (done bool, err error) {
+	switch ev.Type {
+	case service.EventQueued:
+		return false, sse.event(ev.ID, ev.Type, struct{}{})
+	case service.EventDelta:
+		return false, sse.event(ev.ID, ev.Type, sseDeltaPayload{Text: ev.Text})
+	case service.EventToolStart, service.EventToolEnd:
+		return false, sse.event(ev.ID, ev.Type, sseToolPayload{Tool: ev.Tool, Ref: ev.ToolRef})
+	case service.EventDone, service.EventCancelled:
+		return true, sse.event(ev.ID, ev.Type, ev.Result)
+	case service.EventError:
+		e := classifyRunError(ev.Err)
+		return true, sse.event(ev.ID, ev.Type, sseErrorPayload{Code: e.code, Message: e.message})
+	default:
+		return false, nil
+	}
 }
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/service"
+)
+
+// ToolCallInfo describes a tool the model called while answering.
+type ToolCallInfo struct {
+	Tool string `json:"tool"`
+	Ref  string `json:"ref,omitempty"`
+}
+
+// ChatCompleteResponse is the JSON body returned by POST /chat/complete.
+type ChatCompleteResponse struct {
+	SessionID     string            `json:"sessionId"`
+	RunID         string            `json:"runId"`
+	Answer        string            `json:"answer"`
+	UserMessageID string            `json:"userMessageId"`
+	MessageID     string            `json:"messageId"`
+	Model         string            `json:"model"`
+	ToolCalls     []ToolCallInfo    `json:"toolCalls"`
+	Usage         service.ChatUsage `json:"usage"`
+	LatencyMs     int64             `json:"latencyMs"`
+}
+
+// HandleChatComplete processes POST /chat/complete for server-to-server
+// callers that cannot consume SSE. It accepts the same body as HandleChat,
+// waits for the turn to finish and returns the answer as a single JSON
+// document. A failed turn is answered with the status of its error, as
+// mapped by classifyRunError.
+func (h *ChatHandler) HandleChatComplete(w http.ResponseWriter, r *http.Request) {
+	chatInput, ok := decodeChatRequest(w, r)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	run, err := h.chatService.StartRun(r.Context(), chatInput)
+	if err != nil {
+		writeStartRunError(w, err)
+		return
+	}
+
+	toolCalls := []ToolCallInfo{}
+	for ev := range run.Subscribe(r.Context(), 0) {
+		switch ev.Type {
+		case service.EventToolStart:
+			toolCalls = append(toolCalls, ToolCallInfo{Tool: ev.Tool, Ref: ev.ToolRef})
+		case service.EventError:
+			e := classifyRunError(ev.Err)
+			writeError(w, e.status, e.message)
+			return
+		case service.EventCancelled:
+			writeError(w, http.StatusConflict, "generation was cancelled")
+			return
+		case service.EventDone:
+			writeJSON(w, http.StatusOK, ChatCompleteResponse{
+				SessionID:     ev.Result.SessionID,
+				RunID:         run.ID,
+				Answer:        ev.Result.Text,
+				UserMessageID: ev.Result.UserMessageID,
+				MessageID:     ev.Result.MessageID,
+				Model:         ev.Result.Model,
+				ToolCalls:     toolCalls,
+				Usage:         ev.Result.Usage,
+				LatencyMs:     time.Since(start).Milliseconds(),
+			})
+			return
+		}
+	}
+	// The client went away before the turn finished; the run keeps going
+	// and its result is saved to the session.
+}
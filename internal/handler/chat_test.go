@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/ai/flow"
+	"github.com/FPT-OJT/minstant-ai.git/internal/repository"
+	"github.com/FPT-OJT/minstant-ai.git/internal/service"
+)
+
+func TestClassifyRunError(t *testing.T) {
+	secret := errors.New(`ERROR: relation "wallets" does not exist (SQLSTATE 42P01)`)
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"timeout", fmt.Errorf("%w: %w", context.DeadlineExceeded, secret), http.StatusGatewayTimeout, errCodeTimeout},
+		{"provider unavailable", &flow.FailedError{Err: &flow.UnavailableError{Err: secret}}, http.StatusBadGateway, errCodeProviderUnavailable},
+		{"quota exceeded", &service.QuotaExceededError{Period: "daily"}, http.StatusTooManyRequests, errCodeQuotaExceeded},
+		{"session forbidden", fmt.Errorf("load: %w", &repository.SessionForbiddenError{SessionID: "s"}), http.StatusForbidden, errCodeSessionForbidden},
+		{"user mismatch", &flow.UserMismatchError{UserID: "u"}, http.StatusForbidden, errCodeForbidden},
+		{"session busy", service.ErrSessionBusy, http.StatusConflict, errCodeSessionBusy},
+		{"other", secret, http.StatusInternalServerError, errCodeGenerationFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := classifyRunError(tt.err)
+			if e.status != tt.status || e.code != tt.code {
+				t.Fatalf("classifyRunError = %d %s, want %d %s", e.status, e.code, tt.status, tt.code)
+			}
+			if e.message == "" || e.message == tt.err.Error() {
+				t.Fatalf("message = %q, want a fixed message", e.message)
+			}
+		})
+	}
+}
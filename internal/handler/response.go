@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/firebase/genkit/go/core/x/session"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+	"github.com/FPT-OJT/minstant-ai.git/internal/repository"
+)
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error body in the same shape as the chat handler.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{
+		"error": message,
+	})
+}
+
+// principal returns the authenticated caller of r. If there is none (the
+// route is not behind middleware.RequireAuth), it writes a 401 response and
+// returns false.
+func principal(w http.ResponseWriter, r *http.Request) (*auth.Principal, bool) {
+	p, ok := auth.FromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "missing authentication")
+	}
+	return p, ok
+}
+
+// writeSessionError maps session lookup errors to HTTP status codes.
+func writeSessionError(w http.ResponseWriter, err error) {
+	var (
+		notFound  *session.NotFoundError
+		forbidden *repository.SessionForbiddenError
+	)
+	switch {
+	case errors.As(err, &notFound):
+		writeError(w, http.StatusNotFound, "session not found")
+	case errors.As(err, &forbidden):
+		writeError(w, http.StatusForbidden, "session belongs to another user")
+	default:
+		writeError(w, http.StatusInternalServerError, "internal server error")
+	}
+}
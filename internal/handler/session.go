@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/service"
+)
+
+const (
+	defaultSessionPageSize = 20
+	maxSessionPageSize     = 100
+	maxSessionTitleLength  = 200
+)
+
+// RenameSessionRequest is the expected JSON body for PATCH /sessions/{id}.
+type RenameSessionRequest struct {
+	Title string `json:"title"`
+}
+
+// SessionHandler handles the conversation management endpoints.
+type SessionHandler struct {
+	sessionService service.SessionService
+}
+
+// NewSessionHandler creates a new SessionHandler with the given SessionService.
+func NewSessionHandler(ss service.SessionService) *SessionHandler {
+	return &SessionHandler{sessionService: ss}
+}
+
+// ListSessions handles GET /sessions. It returns the caller's sessions newest
+// first, paginated with the "limit" and "offset" query parameters.
+func (h *SessionHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principal(w, r)
+	if !ok {
+		return
+	}
+
+	limit, err := queryInt(r, "limit", defaultSessionPageSize)
+	if err != nil || limit < 1 || limit > maxSessionPageSize {
+		writeError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+		return
+	}
+
+	list, err := h.sessionService.ListSessions(r.Context(), caller.UserID, limit, offset)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// GetSession handles GET /sessions/{id} and returns the session's messages.
+func (h *SessionHandler) GetSession(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principal(w, r)
+	if !ok {
+		return
+	}
+
+	detail, err := h.sessionService.GetSession(r.Context(), caller.UserID, chi.URLParam(r, "id"))
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// RenameSession handles PATCH /sessions/{id} and sets the session title.
+func (h *SessionHandler) RenameSession(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principal(w, r)
+	if !ok {
+		return
+	}
+
+	var req RenameSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		writeError(w, http.StatusBadRequest, "title is required")
+		return
+	}
+	if len([]rune(title)) > maxSessionTitleLength {
+		writeError(w, http.StatusBadRequest, "title must be at most 200 characters")
+		return
+	}
+
+	if err := h.sessionService.RenameSession(r.Context(), caller.UserID, chi.URLParam(r, "id"), title); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteSession handles DELETE /sessions/{id}.
+func (h *SessionHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principal(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.sessionService.DeleteSession(r.Context(), caller.UserID, chi.URLParam(r, "id")); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryInt reads an integer query parameter, returning def when it is absent.
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
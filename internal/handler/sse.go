@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sseProtocolVersion is the version of the chat event protocol, sent in the
+// X-Chat-Protocol-Version response header.
+//
+// Events:
+//   - queued:     {}                               waiting for the session's previous turn
+//   - delta:      {"text": "..."}                  a piece of the answer
+//   - tool_start: {"tool": "...", "ref": "..."}    a tool started running
+//   - tool_end:   {"tool": "...", "ref": "..."}    a tool finished
+//   - error:      {"code": "...", "message": "..."} terminal failure, see the errCode constants
+//   - done:       {"sessionId", "userMessageId", "messageId", "model", "usage"} terminal success
+//   - cancelled:  same fields as done, partial answer  terminal, cancelled by the user
+//
+// Every event carries a sequential "id:". A client that loses its
+// connection reconnects to GET /chat/runs/{runId}/stream (the run ID is in
+// the X-Run-Id header) with a Last-Event-ID header to receive the events it
+// missed and continue live. POST /chat/runs/{runId}/cancel stops a run; the
+// partial answer is saved and the stream ends with a cancelled event.
+//
+// Comment lines (": heartbeat") are sent periodically to keep idle
+// connections open and must be ignored by clients.
+const sseProtocolVersion = "1"
+
+// sseHeartbeatInterval is how often a heartbeat comment is sent while the
+// stream is otherwise idle.
+const sseHeartbeatInterval = 15 * time.Second
+
+// Error codes sent in SSE error events. Each comes with a fixed message; the
+// underlying error is only logged.
+const (
+	errCodeGenerationFailed    = "generation_failed"
+	errCodeTimeout             = "timeout"
+	errCodeProviderUnavailable = "provider_unavailable"
+	errCodeQuotaExceeded       = "quota_exceeded"
+	errCodeSessionForbidden    = "session_forbidden"
+	errCodeSessionBusy         = "session_busy"
+	errCodeForbidden           = "forbidden"
+)
+
+// sseDeltaPayload is the data of a delta event.
+type sseDeltaPayload struct {
+	Text string `json:"text"`
+}
+
+// sseToolPayload is the data of tool_start and tool_end events.
+type sseToolPayload struct {
+	Tool string `json:"tool"`
+	Ref  string `json:"ref,omitempty"`
+}
+
+// sseErrorPayload is the data of an error event.
+type sseErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// sseWriter writes Server-Sent Events to a streaming response.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// startSSE writes the SSE response headers and returns a writer for events.
+// runID is sent in the X-Run-Id header so the client can resume the stream.
+func startSSE(w http.ResponseWriter, flusher http.Flusher, runID string) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Chat-Protocol-Version", sseProtocolVersion)
+	w.Header().Set("X-Run-Id", runID)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseWriter{w: w, flusher: flusher}
+}
+
+// event writes a named event with payload encoded as JSON. Every line of the
+// encoded payload is sent as its own "data:" line. The event ID is what
+// clients send back in Last-Event-ID when resuming.
+func (s *sseWriter) event(id int, name string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "id: %d\n", id)
+	fmt.Fprintf(&sb, "event: %s\n", name)
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(&sb, "data: %s\n", line)
+	}
+	sb.WriteString("\n")
+
+	if _, err := fmt.Fprint(s.w, sb.String()); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// comment writes an SSE comment line, used for heartbeats.
+func (s *sseWriter) comment(text string) error {
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", text); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/service"
+)
+
+// UsageHandler handles the token usage endpoint.
+type UsageHandler struct {
+	usageService service.UsageService
+}
+
+// NewUsageHandler creates a new UsageHandler with the given UsageService.
+func NewUsageHandler(us service.UsageService) *UsageHandler {
+	return &UsageHandler{usageService: us}
+}
+
+// GetUsage handles GET /usage. It returns the caller's token usage and
+// quotas for the current UTC day and month.
+func (h *UsageHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principal(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := h.usageService.GetUsage(r.Context(), caller.UserID, caller.Plan)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load usage")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
@@ -2,27 +2,135 @@
 package middleware
 
 import (
-	"context"
-	"crypto/rsa"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/FPT-OJT/minstant-ai.git/internal/constants"
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// JWTAuth returns a middleware that verifies RS256 JWTs in the Authorization
-// header using the provided RSA public key.
+// supportedAlgorithms are the signing algorithms verifiable with RSA keys.
+var supportedAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+
+// Claims are the JWT claims understood by the API.
+type Claims struct {
+	jwt.RegisteredClaims
+	// Roles holds the "roles" claim, a list or a single string. Role is
+	// the singular "role" claim some issuers use instead.
+	Roles stringList `json:"roles,omitempty"`
+	Role  string     `json:"role,omitempty"`
+	// Scope is the space-separated OAuth "scope" claim; Scp is the list
+	// form some issuers use instead.
+	Scope  string     `json:"scope,omitempty"`
+	Scp    stringList `json:"scp,omitempty"`
+	Plan   string     `json:"plan,omitempty"`
+	Locale string     `json:"locale,omitempty"`
+}
+
+// stringList decodes a claim holding either a list of strings or a single
+// string. Non-string list items are ignored.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*l = stringList{v}
+	case []any:
+		items := make(stringList, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				items = append(items, s)
+			}
+		}
+		*l = items
+	default:
+		*l = nil
+	}
+	return nil
+}
+
+// principalFromClaims builds the principal of validated claims. The subject
+// must be a UUID.
+func principalFromClaims(c *Claims) (*auth.Principal, error) {
+	userID, err := auth.ParseUserID(c.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []string(c.Roles)
+	if len(roles) == 0 && c.Role != "" {
+		roles = []string{c.Role}
+	}
+	scopes := strings.Fields(c.Scope)
+	if len(scopes) == 0 {
+		scopes = c.Scp
+	}
+	return &auth.Principal{
+		UserID:  userID,
+		Roles:   roles,
+		Scopes:  scopes,
+		TokenID: c.ID,
+		Plan:    c.Plan,
+		Locale:  c.Locale,
+	}, nil
+}
+
+// newParser returns a JWT parser enforcing cfg: the accepted algorithms,
+// issuer, audience, clock skew leeway and the required time claims.
+func newParser(cfg config.AuthConfig) (*jwt.Parser, error) {
+	for _, alg := range cfg.Algorithms {
+		if !slices.Contains(supportedAlgorithms, alg) {
+			return nil, fmt.Errorf("unsupported JWT algorithm %q", alg)
+		}
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(cfg.Algorithms),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	if cfg.RequireExpiration {
+		opts = append(opts, jwt.WithExpirationRequired())
+	}
+	if cfg.VerifyIssuedAt {
+		opts = append(opts, jwt.WithIssuedAt())
+	}
+	return jwt.NewParser(opts...), nil
+}
+
+// JWTAuth returns a middleware that verifies RSA-signed JWTs in the
+// Authorization header with the key keys resolves for the token's "kid",
+// validating its claims against cfg.
 //
 // Behavior:
 //   - If NO Authorization header is present, it allows the request through
 //     unauthenticated (upstream services handle public routes).
-//   - If a Bearer token IS present, it must be valid and unexpired.
+//   - If a Bearer token IS present, it must be signed with one of the
+//     configured algorithms, unexpired and valid (a "nbf" claim is always
+//     checked), and match the configured issuer and audience.
 //   - If invalid, returns 401 Unauthorized immediately.
-//   - If valid, extracts the "sub" claim, injects it into the request context,
-//     and adds the "X-User-Id" HTTP header for upstream services.
-func JWTAuth(pubKey *rsa.PublicKey) func(http.Handler) http.Handler {
+//   - If valid, injects the caller's auth.Principal into the request
+//     context, and adds the "X-User-Id" HTTP header for upstream services.
+func JWTAuth(keys KeySource, cfg config.AuthConfig) (func(http.Handler) http.Handler, error) {
+	parser, err := newParser(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -38,11 +146,10 @@ func JWTAuth(pubKey *rsa.PublicKey) func(http.Handler) http.Handler {
 			}
 			tokenStr := parts[1]
 
-			token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-				}
-				return pubKey, nil
+			claims := &Claims{}
+			token, err := parser.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+				kid, _ := token.Header["kid"].(string)
+				return keys.Key(r.Context(), kid)
 			})
 
 			if err != nil || !token.Valid {
@@ -50,26 +157,31 @@ func JWTAuth(pubKey *rsa.PublicKey) func(http.Handler) http.Handler {
 				return
 			}
 
-			claims, ok := token.Claims.(jwt.MapClaims)
-			if !ok {
-				sendUnauthorized(w, "Invalid token claims")
+			if claims.Subject == "" {
+				sendUnauthorized(w, "Token is missing subject (sub) claim")
 				return
 			}
 
-			sub, err := claims.GetSubject()
-			if err != nil || sub == "" {
-				sendUnauthorized(w, "Token is missing subject (sub) claim")
-				return
+			if cfg.MaxTokenAge > 0 {
+				if claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > cfg.MaxTokenAge+cfg.Leeway {
+					sendUnauthorized(w, "Token is too old")
+					return
+				}
 			}
 
-			ctx := context.WithValue(r.Context(), constants.UserContextKey{}, sub)
-			r = r.WithContext(ctx)
+			principal, err := principalFromClaims(claims)
+			if err != nil {
+				sendUnauthorized(w, "Token subject (sub) must be a UUID")
+				return
+			}
+			principal.GrantPermissions(cfg.RolePermissions, cfg.ScopePermissions)
+			r = r.WithContext(auth.NewContext(r.Context(), principal))
 
-			r.Header.Set("X-User-Id", sub)
+			r.Header.Set("X-User-Id", principal.UserID)
 
 			next.ServeHTTP(w, r)
 		})
-	}
+	}, nil
 }
 
 // sendUnauthorized writes a 401 JSON response.
@@ -79,10 +191,11 @@ func sendUnauthorized(w http.ResponseWriter, message string) {
 	fmt.Fprintf(w, `{"code":"unauthorized","message":%q}`, message)
 }
 
+// RequireAuth rejects requests without an authenticated principal.
 func RequireAuth() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Context().Value(constants.UserContextKey{}) == nil {
+			if _, ok := auth.FromContext(r.Context()); !ok {
 				sendUnauthorized(w, "Missing authentication")
 				return
 			}
@@ -91,6 +204,40 @@ func RequireAuth() func(http.Handler) http.Handler {
 	}
 }
 
-func ExtractUserID(r *http.Request) string {
-	return r.Context().Value(constants.UserContextKey{}).(string)
+// RequireRole rejects requests whose principal has none of roles with 403
+// Forbidden. It must run after RequireAuth.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := auth.FromContext(r.Context())
+			if !slices.ContainsFunc(roles, p.HasRole) {
+				sendForbidden(w, "Missing required role")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequirePermission rejects requests whose principal lacks permission, from
+// its roles or allowed scopes, with 403 Forbidden. It must run after
+// RequireAuth.
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := auth.FromContext(r.Context())
+			if !p.Can(permission) {
+				sendForbidden(w, "Missing required permission")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sendForbidden writes a 403 JSON response.
+func sendForbidden(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, `{"code":"forbidden","message":%q}`, message)
 }
@@ -0,0 +1,404 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+const testUserID = "2f1d7a0e-8c1b-4f5e-9a43-1d2c3b4a5f60"
+
+func testAuthConfig() config.AuthConfig {
+	return config.AuthConfig{
+		Issuer:            "https://issuer.test",
+		Audience:          "minstant-ai",
+		Algorithms:        []string{"RS256", "PS256"},
+		Leeway:            30 * time.Second,
+		RequireExpiration: true,
+		VerifyIssuedAt:    true,
+		MaxTokenAge:       time.Hour,
+		RolePermissions: map[string][]string{
+			"admin":   {auth.PermAll},
+			"support": {auth.PermInspectSessions},
+		},
+		ScopePermissions: []string{auth.PermManageUsage},
+	}
+}
+
+// testClaims returns valid claims for testAuthConfig, changed by edit.
+func testClaims(edit func(jwt.MapClaims)) jwt.MapClaims {
+	now := time.Now()
+	c := jwt.MapClaims{
+		"iss": "https://issuer.test",
+		"aud": "minstant-ai",
+		"sub": testUserID,
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	if edit != nil {
+		edit(c)
+	}
+	return c
+}
+
+// sign returns the token of claims signed with method and key.
+func sign(t *testing.T, method jwt.SigningMethod, key any, claims jwt.Claims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// authenticate runs a request with the Authorization header through mw and
+// returns the response and the principal reaching the handler, if any.
+func authenticate(t *testing.T, mw func(http.Handler) http.Handler, header string) (*httptest.ResponseRecorder, *auth.Principal) {
+	t.Helper()
+	var principal *auth.Principal
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = auth.FromContext(r.Context())
+		if got := r.Header.Get("X-User-Id"); principal != nil && got != principal.UserID {
+			t.Errorf("X-User-Id = %q, want %q", got, principal.UserID)
+		}
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if header != "" {
+		req.Header.Set("Authorization", header)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec, principal
+}
+
+func TestJWTAuth(t *testing.T) {
+	keys := testKeys()
+	mw, err := JWTAuth(StaticKey{PublicKey: &keys[0].PublicKey}, testAuthConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256 := func(edit func(jwt.MapClaims)) string {
+		return "Bearer " + sign(t, jwt.SigningMethodRS256, keys[0], testClaims(edit))
+	}
+
+	tests := []struct {
+		name        string
+		header      string
+		wantStatus  int
+		wantMessage string
+		wantUser    string
+	}{
+		{name: "no header", wantStatus: http.StatusOK},
+		{name: "valid", header: rs256(nil), wantStatus: http.StatusOK, wantUser: testUserID},
+		{
+			name:       "valid PS256",
+			header:     "Bearer " + sign(t, jwt.SigningMethodPS256, keys[0], testClaims(nil)),
+			wantStatus: http.StatusOK,
+			wantUser:   testUserID,
+		},
+		{
+			name:       "subject in canonical form",
+			header:     rs256(func(c jwt.MapClaims) { c["sub"] = strings.ToUpper(testUserID) }),
+			wantStatus: http.StatusOK,
+			wantUser:   testUserID,
+		},
+		{
+			name:        "malformed header",
+			header:      "Token abc",
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Malformed Authorization header",
+		},
+		{
+			name:        "not a JWT",
+			header:      "Bearer abc",
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "wrong issuer",
+			header:      rs256(func(c jwt.MapClaims) { c["iss"] = "https://other.test" }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "missing issuer",
+			header:      rs256(func(c jwt.MapClaims) { delete(c, "iss") }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "wrong audience",
+			header:      rs256(func(c jwt.MapClaims) { c["aud"] = []string{"other", "another"} }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:       "audience among others",
+			header:     rs256(func(c jwt.MapClaims) { c["aud"] = []string{"other", "minstant-ai"} }),
+			wantStatus: http.StatusOK,
+			wantUser:   testUserID,
+		},
+		{
+			name:        "expired",
+			header:      rs256(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:       "expired within leeway",
+			header:     rs256(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-10 * time.Second).Unix() }),
+			wantStatus: http.StatusOK,
+			wantUser:   testUserID,
+		},
+		{
+			name:        "missing exp",
+			header:      rs256(func(c jwt.MapClaims) { delete(c, "exp") }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "not yet valid",
+			header:      rs256(func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Hour).Unix() }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "issued in the future",
+			header:      rs256(func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "too old",
+			header:      rs256(func(c jwt.MapClaims) { c["iat"] = time.Now().Add(-2 * time.Hour).Unix() }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Token is too old",
+		},
+		{
+			name:        "missing iat",
+			header:      rs256(func(c jwt.MapClaims) { delete(c, "iat") }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Token is too old",
+		},
+		{
+			name:        "signed with another key",
+			header:      "Bearer " + sign(t, jwt.SigningMethodRS256, keys[1], testClaims(nil)),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "algorithm not configured",
+			header:      "Bearer " + sign(t, jwt.SigningMethodRS512, keys[0], testClaims(nil)),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			// HMAC keyed with the public key, the classic algorithm
+			// confusion attack.
+			name:        "HS256",
+			header:      "Bearer " + sign(t, jwt.SigningMethodHS256, keys[0].PublicKey.N.Bytes(), testClaims(nil)),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "alg none",
+			header:      "Bearer " + sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, testClaims(nil)),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "missing subject",
+			header:      rs256(func(c jwt.MapClaims) { delete(c, "sub") }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "missing subject",
+		},
+		{
+			name:        "subject not a UUID",
+			header:      rs256(func(c jwt.MapClaims) { c["sub"] = "alice" }),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "must be a UUID",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, principal := authenticate(t, mw, tt.header)
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantMessage) {
+				t.Fatalf("response = %d %s, want %d %q", rec.Code, rec.Body, tt.wantStatus, tt.wantMessage)
+			}
+			var userID string
+			if principal != nil {
+				userID = principal.UserID
+			}
+			if userID != tt.wantUser {
+				t.Fatalf("principal user = %q, want %q", userID, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestJWTAuthPermissions(t *testing.T) {
+	keys := testKeys()
+
+	tests := []struct {
+		name             string
+		claims           jwt.MapClaims
+		scopePermissions []string
+		wantRoles        []string
+		wantScopes       []string
+		wantPermissions  []string
+	}{
+		{
+			name:            "roles",
+			claims:          jwt.MapClaims{"roles": []string{"support", "unknown"}},
+			wantRoles:       []string{"support", "unknown"},
+			wantPermissions: []string{auth.PermInspectSessions},
+		},
+		{
+			name:            "single role claim",
+			claims:          jwt.MapClaims{"role": "admin"},
+			wantRoles:       []string{"admin"},
+			wantPermissions: []string{auth.PermAll},
+		},
+		{
+			name:            "roles as a string",
+			claims:          jwt.MapClaims{"roles": "support"},
+			wantRoles:       []string{"support"},
+			wantPermissions: []string{auth.PermInspectSessions},
+		},
+		{
+			name:            "allowed scope",
+			claims:          jwt.MapClaims{"scope": "openid admin:usage"},
+			wantScopes:      []string{"openid", "admin:usage"},
+			wantPermissions: []string{auth.PermManageUsage},
+		},
+		{
+			name:            "scope list",
+			claims:          jwt.MapClaims{"scp": []string{"admin:usage"}},
+			wantScopes:      []string{"admin:usage"},
+			wantPermissions: []string{auth.PermManageUsage},
+		},
+		{
+			name:       "scope outside the allow-list",
+			claims:     jwt.MapClaims{"scope": "admin:sessions admin:prompts"},
+			wantScopes: []string{"admin:sessions", "admin:prompts"},
+		},
+		{
+			name:             "scopes grant nothing by default",
+			claims:           jwt.MapClaims{"scope": "admin:usage"},
+			scopePermissions: []string{},
+			wantScopes:       []string{"admin:usage"},
+		},
+		{
+			name:             "wildcard scope is never granted",
+			claims:           jwt.MapClaims{"scope": "*"},
+			scopePermissions: []string{auth.PermAll},
+			wantScopes:       []string{"*"},
+		},
+		{
+			name:            "roles and scopes combined",
+			claims:          jwt.MapClaims{"roles": []string{"support"}, "scope": "admin:usage admin:sessions"},
+			wantRoles:       []string{"support"},
+			wantScopes:      []string{"admin:usage", "admin:sessions"},
+			wantPermissions: []string{auth.PermInspectSessions, auth.PermManageUsage},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testAuthConfig()
+			if tt.scopePermissions != nil {
+				cfg.ScopePermissions = tt.scopePermissions
+			}
+			mw, err := JWTAuth(StaticKey{PublicKey: &keys[0].PublicKey}, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := testClaims(func(c jwt.MapClaims) {
+				for k, v := range tt.claims {
+					c[k] = v
+				}
+			})
+
+			rec, p := authenticate(t, mw, "Bearer "+sign(t, jwt.SigningMethodRS256, keys[0], claims))
+			if p == nil {
+				t.Fatalf("response = %d %s, want the request authenticated", rec.Code, rec.Body)
+			}
+			if !slices.Equal(p.Roles, tt.wantRoles) || !slices.Equal(p.Scopes, tt.wantScopes) {
+				t.Errorf("roles, scopes = %v, %v, want %v, %v", p.Roles, p.Scopes, tt.wantRoles, tt.wantScopes)
+			}
+			if !slices.Equal(p.Permissions, tt.wantPermissions) {
+				t.Errorf("permissions = %v, want %v", p.Permissions, tt.wantPermissions)
+			}
+		})
+	}
+}
+
+func TestJWTAuthUnsupportedAlgorithm(t *testing.T) {
+	for _, alg := range []string{"HS256", "none", "ES256"} {
+		cfg := testAuthConfig()
+		cfg.Algorithms = []string{"RS256", alg}
+		if _, err := JWTAuth(StaticKey{}, cfg); err == nil {
+			t.Errorf("JWTAuth accepted algorithm %q", alg)
+		}
+	}
+}
+
+func TestStringList(t *testing.T) {
+	tests := []struct {
+		data string
+		want stringList
+	}{
+		{`"admin"`, stringList{"admin"}},
+		{`["admin", "support"]`, stringList{"admin", "support"}},
+		{`["admin", 1, null]`, stringList{"admin"}},
+		{`[]`, stringList{}},
+		{`null`, nil},
+		{`42`, nil},
+	}
+	for _, tt := range tests {
+		var got stringList
+		if err := json.Unmarshal([]byte(tt.data), &got); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", tt.data, err)
+		}
+		if !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		want      int
+	}{
+		{"one of the roles", &auth.Principal{UserID: testUserID, Roles: []string{"viewer", "support"}}, http.StatusOK},
+		{"other roles", &auth.Principal{UserID: testUserID, Roles: []string{"viewer"}}, http.StatusForbidden},
+		{"permission without role", &auth.Principal{UserID: testUserID, Permissions: []string{auth.PermAll}}, http.StatusForbidden},
+		{"no principal", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := RequireRole("admin", "support")(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+			if tt.principal != nil {
+				req = req.WithContext(auth.NewContext(req.Context(), tt.principal))
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
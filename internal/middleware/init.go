@@ -1,10 +1,12 @@
 package middleware
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"errors"
+	"log"
 
 	"github.com/FPT-OJT/minstant-ai.git/internal/config"
 	"github.com/go-chi/chi/v5"
@@ -12,28 +14,63 @@ import (
 	"github.com/go-chi/cors"
 )
 
-func SetupMiddleware(r *chi.Mux, cfg *config.Config) error {
-	pubKey, err := loadPublicKey(cfg.PublicKey)
+// SetupMiddleware installs the global middleware. JWKS refreshes stop when
+// ctx is done.
+func SetupMiddleware(ctx context.Context, r *chi.Mux, cfg *config.Config, limiter *RateLimiter) error {
+	keys, err := loadKeySource(ctx, cfg.Auth)
+	if err != nil {
+		return err
+	}
+	authMiddleware, err := JWTAuth(keys, cfg.Auth)
 	if err != nil {
 		return err
 	}
-	authMiddleware := JWTAuth(pubKey)
 
+	if cfg.RateLimit.TrustProxy {
+		r.Use(middleware.RealIP)
+	}
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Last-Event-ID"},
+		ExposedHeaders:   []string{"Link", "X-Run-Id", "X-Chat-Protocol-Version", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 	r.Use(authMiddleware)
+	r.Use(limiter.Requests())
 
 	return nil
 }
 
+// loadKeySource builds the JWT key source: the JWKS, if configured, falling
+// back to the static public key, if configured. The JWKS may fail to load
+// initially when there is a static key to fall back to.
+func loadKeySource(ctx context.Context, cfg config.AuthConfig) (KeySource, error) {
+	var keys FallbackKeys
+	if cfg.JWKSSource != "" {
+		jwks := NewJWKS(cfg.JWKSSource, cfg.JWKSRefreshInterval, cfg.JWKSMinRefreshInterval)
+		if err := jwks.Refresh(ctx); err != nil {
+			if cfg.PublicKey == "" {
+				return nil, err
+			}
+			log.Printf("%v; falling back to PUBLIC_KEY until it loads", err)
+		}
+		go jwks.Run(ctx)
+		keys = append(keys, jwks)
+	}
+	if cfg.PublicKey != "" || len(keys) == 0 {
+		pubKey, err := loadPublicKey(cfg.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, StaticKey{PublicKey: pubKey})
+	}
+	return keys, nil
+}
+
 func loadPublicKey(rawKey string) (*rsa.PublicKey, error) {
 	derBytes, err := base64.StdEncoding.DecodeString(rawKey)
 	if err != nil {
@@ -0,0 +1,248 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrUnknownKey is returned by a KeySource that has no key for a token.
+var ErrUnknownKey = errors.New("no verification key for token")
+
+// jwksFetchTimeout bounds a single JWKS download.
+const jwksFetchTimeout = 10 * time.Second
+
+// KeySource resolves the public key that verifies a token, given the token's
+// "kid" header (empty if it has none).
+type KeySource interface {
+	Key(ctx context.Context, kid string) (*rsa.PublicKey, error)
+}
+
+// KeySourceFunc adapts a function to a KeySource, e.g. as a test stub.
+type KeySourceFunc func(ctx context.Context, kid string) (*rsa.PublicKey, error)
+
+func (f KeySourceFunc) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	return f(ctx, kid)
+}
+
+// StaticKey is a KeySource verifying every token with the same key.
+type StaticKey struct {
+	PublicKey *rsa.PublicKey
+}
+
+func (s StaticKey) Key(context.Context, string) (*rsa.PublicKey, error) {
+	return s.PublicKey, nil
+}
+
+// FallbackKeys tries each of its sources in order and returns the first key
+// found. It returns the last error if none has a key.
+type FallbackKeys []KeySource
+
+func (f FallbackKeys) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	err := ErrUnknownKey
+	for _, src := range f {
+		var key *rsa.PublicKey
+		if key, err = src.Key(ctx, kid); err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
+}
+
+// JWKS is a KeySource backed by a JSON Web Key Set loaded from a URL or a
+// file. Keys are cached and reloaded every refresh interval by Run, and on
+// demand when a token names an unknown "kid", at most every minRefresh.
+type JWKS struct {
+	source     string
+	client     *http.Client
+	refresh    time.Duration
+	minRefresh time.Duration
+	// refreshes merges the on-demand reloads of concurrent requests.
+	refreshes singleflight.Group
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewJWKS creates a JWKS reading source: an http(s) URL, a file:// URL or a
+// file path. Keys are not loaded until Refresh or Run is called.
+func NewJWKS(source string, refresh, minRefresh time.Duration) *JWKS {
+	return &JWKS{
+		source:     source,
+		client:     &http.Client{Timeout: jwksFetchTimeout},
+		refresh:    refresh,
+		minRefresh: minRefresh,
+	}
+}
+
+// Key returns the key with the given kid. A token without a kid can only be
+// verified if the set holds a single key.
+func (j *JWKS) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+
+	// The auth service may have rotated to a new key.
+	if err := j.refreshOnDemand(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: kid %q", ErrUnknownKey, kid)
+}
+
+// refreshOnDemand reloads the key set unless a reload started less than
+// minRefresh ago. Concurrent callers share a single reload, which is not
+// cancelled with the request that started it.
+func (j *JWKS) refreshOnDemand(ctx context.Context) error {
+	ch := j.refreshes.DoChan("refresh", func() (any, error) {
+		j.mu.Lock()
+		recent := time.Since(j.fetchedAt) < j.minRefresh
+		j.mu.Unlock()
+		if recent {
+			return nil, nil
+		}
+		return nil, j.Refresh(context.WithoutCancel(ctx))
+	})
+
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (j *JWKS) lookup(kid string) (*rsa.PublicKey, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// Refresh reloads the key set. On failure the previous keys are kept.
+func (j *JWKS) Refresh(ctx context.Context) error {
+	// On-demand reloads are throttled from the start of the last attempt,
+	// failed ones included, so a slow or unreachable source is not hammered
+	// by tokens with unknown kids.
+	j.mu.Lock()
+	j.fetchedAt = time.Now()
+	j.mu.Unlock()
+
+	data, err := j.fetch(ctx)
+	if err == nil {
+		var keys map[string]*rsa.PublicKey
+		if keys, err = ParseJWKS(data); err == nil {
+			j.mu.Lock()
+			j.keys = keys
+			j.mu.Unlock()
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("jwks refresh %s: %w", j.source, err)
+	}
+	return nil
+}
+
+// Run refreshes the key set every refresh interval until ctx is done.
+func (j *JWKS) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.Refresh(ctx); err != nil {
+				log.Printf("%v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (j *JWKS) fetch(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(j.source, "http://") && !strings.HasPrefix(j.source, "https://") {
+		return os.ReadFile(strings.TrimPrefix(j.source, "file://"))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// jsonWebKey is the subset of a JSON Web Key (RFC 7517) needed for RSA
+// signature keys.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ParseJWKS parses the RSA signature keys of a JSON Web Key Set, keyed by
+// kid. Keys of other types or uses are skipped.
+func ParseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("parse jwks: key %q modulus: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("parse jwks: key %q exponent: %w", k.Kid, err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("parse jwks: key %q has an invalid exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("parse jwks: no RSA signature keys")
+	}
+	return keys, nil
+}
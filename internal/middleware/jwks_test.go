@@ -0,0 +1,309 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testKeys are RSA keys shared by the tests of the package, generated once.
+var testKeys = sync.OnceValue(func() []*rsa.PrivateKey {
+	keys := make([]*rsa.PrivateKey, 3)
+	for i := range keys {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		keys[i] = key
+	}
+	return keys
+})
+
+// jwk returns the JSON Web Key of pub.
+func jwk(kid string, pub *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// jwksJSON returns a key set of keys.
+func jwksJSON(t *testing.T, keys ...map[string]string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// jwksServer serves a key set and counts the fetches. Every fetch waits for
+// release, if set, to be closed.
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+
+	mu      sync.Mutex
+	set     []byte
+	release chan struct{}
+}
+
+func newJWKSServer(t *testing.T, set []byte) *jwksServer {
+	s := &jwksServer{set: set}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		release := s.release
+		s.mu.Unlock()
+		if release != nil {
+			<-release
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.Write(s.set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) rotate(set []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set = set
+}
+
+// hold makes the next fetches wait until the returned channel is closed.
+func (s *jwksServer) hold() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release = make(chan struct{})
+	return s.release
+}
+
+func TestJWKSKey(t *testing.T) {
+	keys := testKeys()
+	ctx := context.Background()
+	srv := newJWKSServer(t, jwksJSON(t, jwk("a", &keys[0].PublicKey), jwk("b", &keys[1].PublicKey)))
+	j := NewJWKS(srv.URL, time.Hour, time.Hour)
+
+	// The first lookup loads the set.
+	key, err := j.Key(ctx, "b")
+	if err != nil || !key.Equal(&keys[1].PublicKey) {
+		t.Fatalf("Key(b) = %v, %v, want key b", key, err)
+	}
+	// Known kids are served from the cache.
+	if key, err := j.Key(ctx, "a"); err != nil || !key.Equal(&keys[0].PublicKey) {
+		t.Fatalf("Key(a) = %v, %v, want key a", key, err)
+	}
+	if n := srv.fetches.Load(); n != 1 {
+		t.Fatalf("fetched %d times, want 1", n)
+	}
+	// Without a kid, the key is ambiguous.
+	if _, err := j.Key(ctx, ""); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key(\"\") error = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestJWKSKeyWithoutKid(t *testing.T) {
+	keys := testKeys()
+	srv := newJWKSServer(t, jwksJSON(t, jwk("only", &keys[0].PublicKey)))
+	j := NewJWKS(srv.URL, time.Hour, time.Hour)
+
+	if key, err := j.Key(context.Background(), ""); err != nil || !key.Equal(&keys[0].PublicKey) {
+		t.Fatalf("Key(\"\") = %v, %v, want the only key", key, err)
+	}
+}
+
+func TestJWKSUnknownKidSharesRefresh(t *testing.T) {
+	keys := testKeys()
+	ctx := context.Background()
+	srv := newJWKSServer(t, jwksJSON(t, jwk("old", &keys[0].PublicKey)))
+	j := NewJWKS(srv.URL, time.Hour, time.Hour)
+	if err := j.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Let the next reload through the throttle.
+	j.fetchedAt = time.Time{}
+
+	// The issuer rotates to a new key; concurrent tokens signed with it
+	// share a single reload.
+	srv.rotate(jwksJSON(t, jwk("old", &keys[0].PublicKey), jwk("new", &keys[1].PublicKey)))
+	release := srv.hold()
+
+	const callers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := j.Key(ctx, "new")
+			if err == nil && !key.Equal(&keys[1].PublicKey) {
+				err = errors.New("wrong key")
+			}
+			errs <- err
+		}()
+	}
+	// Let the callers pile up on the reload before it completes.
+	for srv.fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Key(new): %v", err)
+		}
+	}
+	if n := srv.fetches.Load(); n != 2 {
+		t.Fatalf("fetched %d times, want 2 (initial load and one shared reload)", n)
+	}
+}
+
+func TestJWKSThrottlesRefresh(t *testing.T) {
+	keys := testKeys()
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		minRefresh  time.Duration
+		wantFetches int32
+	}{
+		{"throttled", time.Hour, 1},
+		{"not throttled", 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newJWKSServer(t, jwksJSON(t, jwk("a", &keys[0].PublicKey)))
+			j := NewJWKS(srv.URL, time.Hour, tt.minRefresh)
+			if err := j.Refresh(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			for range 2 {
+				if _, err := j.Key(ctx, "unknown"); !errors.Is(err, ErrUnknownKey) {
+					t.Fatalf("Key(unknown) error = %v, want ErrUnknownKey", err)
+				}
+			}
+			if n := srv.fetches.Load(); n != tt.wantFetches {
+				t.Fatalf("fetched %d times, want %d", n, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestJWKSThrottlesFailedRefresh(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	j := NewJWKS(srv.URL, time.Hour, time.Hour)
+
+	if _, err := j.Key(context.Background(), "a"); err == nil || errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key error = %v, want the fetch failure", err)
+	}
+	if _, err := j.Key(context.Background(), "a"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key error = %v, want ErrUnknownKey without fetching", err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("fetched %d times, want 1", n)
+	}
+}
+
+func TestJWKSRefreshKeepsKeysOnFailure(t *testing.T) {
+	keys := testKeys()
+	ctx := context.Background()
+	srv := newJWKSServer(t, jwksJSON(t, jwk("a", &keys[0].PublicKey)))
+	j := NewJWKS(srv.URL, time.Hour, time.Hour)
+	if err := j.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.rotate([]byte(`{"keys": []}`))
+	if err := j.Refresh(ctx); err == nil {
+		t.Fatal("Refresh of an empty set succeeded")
+	}
+	if _, err := j.Key(ctx, "a"); err != nil {
+		t.Fatalf("Key(a) after a failed refresh: %v", err)
+	}
+}
+
+func TestFallbackKeys(t *testing.T) {
+	keys := testKeys()
+	ctx := context.Background()
+	srv := newJWKSServer(t, jwksJSON(t, jwk("a", &keys[0].PublicKey)))
+	src := FallbackKeys{NewJWKS(srv.URL, time.Hour, time.Hour), StaticKey{PublicKey: &keys[2].PublicKey}}
+
+	if key, err := src.Key(ctx, "a"); err != nil || !key.Equal(&keys[0].PublicKey) {
+		t.Fatalf("Key(a) = %v, %v, want the JWKS key", key, err)
+	}
+	if key, err := src.Key(ctx, "other"); err != nil || !key.Equal(&keys[2].PublicKey) {
+		t.Fatalf("Key(other) = %v, %v, want the static key", key, err)
+	}
+	if _, err := (FallbackKeys{}).Key(ctx, "a"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("empty FallbackKeys error = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	pub := &testKeys()[0].PublicKey
+	valid := jwk("rsa", pub)
+	with := func(field, value string) map[string]string {
+		k := map[string]string{}
+		for f, v := range valid {
+			k[f] = v
+		}
+		k[field] = value
+		return k
+	}
+
+	keys, err := ParseJWKS(jwksJSON(t, valid, with("kty", "EC"), with("use", "enc")))
+	if err != nil {
+		t.Fatalf("ParseJWKS: %v", err)
+	}
+	if len(keys) != 1 || !keys["rsa"].Equal(pub) {
+		t.Fatalf("ParseJWKS = %v, want only the RSA signature key", keys)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"not json", []byte(`<html>`), "parse jwks"},
+		{"no keys", []byte(`{"keys": []}`), "no RSA signature keys"},
+		{"only non-RSA keys", jwksJSON(t, with("kty", "EC"), with("kty", "oct")), "no RSA signature keys"},
+		{"only encryption keys", jwksJSON(t, with("use", "enc")), "no RSA signature keys"},
+		{"malformed modulus", jwksJSON(t, with("n", "not base64!")), `key "rsa" modulus`},
+		{"malformed exponent", jwksJSON(t, with("e", "%%")), `key "rsa" exponent`},
+		{"exponent too small", jwksJSON(t, with("e", "AQ")), "invalid exponent"},
+		{"exponent too large", jwksJSON(t, with("e", "AQAAAAAA")), "invalid exponent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseJWKS(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("ParseJWKS error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+	"github.com/FPT-OJT/minstant-ai.git/internal/ratelimit"
+)
+
+// streamRetryAfter is the Retry-After sent when a client has too many open
+// streams, since there is no telling when one of them ends.
+const streamRetryAfter = 5 * time.Second
+
+// RateLimiter builds the rate limiting middleware of the API. Limits are
+// tracked per client: the JWT subject, or the client IP for unauthenticated
+// requests. Responses carry the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers, and rejected requests get 429 with Retry-After.
+// If the store fails, requests are let through.
+type RateLimiter struct {
+	cfg   config.RateLimitConfig
+	store ratelimit.Store
+}
+
+// NewRateLimiter creates a RateLimiter enforcing cfg with the given store.
+func NewRateLimiter(cfg config.RateLimitConfig, store ratelimit.Store) *RateLimiter {
+	return &RateLimiter{cfg: cfg, store: store}
+}
+
+// Requests limits every request of a client. It must run after JWTAuth.
+func (l *RateLimiter) Requests() func(http.Handler) http.Handler {
+	return l.bucket("requests", ratelimit.FromConfig(l.cfg.Requests))
+}
+
+// ChatTurns limits the chat turns a client may start.
+func (l *RateLimiter) ChatTurns() func(http.Handler) http.Handler {
+	return l.bucket("chat", ratelimit.FromConfig(l.cfg.ChatTurns))
+}
+
+// bucket returns a middleware taking a token from the client's bucket of the
+// named limit for every request.
+func (l *RateLimiter) bucket(name string, limit ratelimit.Limit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !limit.Enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res, err := l.store.Take(r.Context(), name+":"+clientKey(r), limit)
+			if err != nil {
+				log.Printf("rate limit %s: %v", name, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("RateLimit-Reset", ceilSeconds(res.Reset))
+			if !res.Allowed {
+				sendTooManyRequests(w, res.RetryAfter, "Rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Streams limits the event streams a client may hold open at once. The slot
+// is held until the handler returns. Streams end at no set time, so
+// RateLimit-Reset is streamRetryAfter while no slot is left, and 0 otherwise.
+// On routes that also take a bucket token, Streams must run first so that a
+// rejected stream does not spend it.
+func (l *RateLimiter) Streams() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if l.cfg.MaxStreams <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			release, open, ok, err := l.store.Acquire(r.Context(), "streams:"+clientKey(r), l.cfg.MaxStreams)
+			if err != nil {
+				log.Printf("rate limit streams: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			remaining := max(l.cfg.MaxStreams-open, 0)
+			reset := time.Duration(0)
+			if remaining == 0 {
+				reset = streamRetryAfter
+			}
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(l.cfg.MaxStreams))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("RateLimit-Reset", ceilSeconds(reset))
+			if !ok {
+				sendTooManyRequests(w, streamRetryAfter, "Too many open streams")
+				return
+			}
+			defer release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientKey identifies the client of r by its JWT subject or, failing that,
+// its IP address.
+func clientKey(r *http.Request) string {
+	if userID, ok := auth.UserIDFromContext(r.Context()); ok {
+		return "user:" + userID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// ceilSeconds formats d as whole seconds, rounded up.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// sendTooManyRequests writes a 429 JSON response asking the client to retry
+// after retryAfter.
+func sendTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", ceilSeconds(max(retryAfter, time.Second)))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, `{"code":"rate_limited","message":%q}`, message)
+}
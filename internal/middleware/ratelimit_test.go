@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+	"github.com/FPT-OJT/minstant-ai.git/internal/ratelimit"
+)
+
+// stubStore answers every Take with res and every Acquire with open and ok.
+type stubStore struct {
+	res  ratelimit.Result
+	open int
+	ok   bool
+	err  error
+
+	keys     []string
+	released int
+}
+
+func (s *stubStore) Take(_ context.Context, key string, _ ratelimit.Limit) (ratelimit.Result, error) {
+	s.keys = append(s.keys, key)
+	return s.res, s.err
+}
+
+func (s *stubStore) Acquire(_ context.Context, key string, _ int) (func(), int, bool, error) {
+	s.keys = append(s.keys, key)
+	return func() { s.released++ }, s.open, s.ok, s.err
+}
+
+// serve runs a request from 192.0.2.1 through mw and reports whether it
+// reached the handler.
+func serve(mw func(http.Handler) http.Handler) (*httptest.ResponseRecorder, bool) {
+	reached := false
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+	req := httptest.NewRequest(http.MethodPost, "/chat", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec, reached
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	cfg := config.RateLimitConfig{ChatTurns: config.RateLimit{PerMinute: 6, Burst: 3}}
+
+	tests := []struct {
+		name        string
+		store       *stubStore
+		wantReached bool
+		wantStatus  int
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "allowed",
+			store:       &stubStore{res: ratelimit.Result{Allowed: true, Limit: 3, Remaining: 2, Reset: 9500 * time.Millisecond}},
+			wantReached: true,
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"RateLimit-Limit": "3", "RateLimit-Remaining": "2", "RateLimit-Reset": "10", "Retry-After": ""},
+		},
+		{
+			name:        "rejected",
+			store:       &stubStore{res: ratelimit.Result{Limit: 3, Reset: 30 * time.Second, RetryAfter: 8200 * time.Millisecond}},
+			wantStatus:  http.StatusTooManyRequests,
+			wantHeaders: map[string]string{"RateLimit-Limit": "3", "RateLimit-Remaining": "0", "RateLimit-Reset": "30", "Retry-After": "9"},
+		},
+		{
+			name:        "retry after at least a second",
+			store:       &stubStore{res: ratelimit.Result{Limit: 3, Reset: time.Second, RetryAfter: 10 * time.Millisecond}},
+			wantStatus:  http.StatusTooManyRequests,
+			wantHeaders: map[string]string{"Retry-After": "1"},
+		},
+		{
+			name:        "store failure lets requests through",
+			store:       &stubStore{err: errors.New("connection refused")},
+			wantReached: true,
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"RateLimit-Limit": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, reached := serve(NewRateLimiter(cfg, tt.store).ChatTurns())
+			if reached != tt.wantReached || rec.Code != tt.wantStatus {
+				t.Fatalf("reached = %v, status = %d, want %v, %d", reached, rec.Code, tt.wantReached, tt.wantStatus)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if len(tt.store.keys) != 1 || tt.store.keys[0] != "chat:ip:192.0.2.1" {
+				t.Errorf("keys = %v, want [chat:ip:192.0.2.1]", tt.store.keys)
+			}
+		})
+	}
+}
+
+func TestRateLimiterBucketDisabled(t *testing.T) {
+	store := &stubStore{}
+	if _, reached := serve(NewRateLimiter(config.RateLimitConfig{}, store).ChatTurns()); !reached || len(store.keys) != 0 {
+		t.Fatalf("reached = %v, keys = %v, want the limit skipped", reached, store.keys)
+	}
+}
+
+func TestRateLimiterStreams(t *testing.T) {
+	cfg := config.RateLimitConfig{MaxStreams: 2}
+
+	tests := []struct {
+		name         string
+		store        *stubStore
+		wantReached  bool
+		wantStatus   int
+		wantHeaders  map[string]string
+		wantReleased int
+	}{
+		{
+			name:         "slot left",
+			store:        &stubStore{open: 1, ok: true},
+			wantReached:  true,
+			wantStatus:   http.StatusOK,
+			wantHeaders:  map[string]string{"RateLimit-Limit": "2", "RateLimit-Remaining": "1", "RateLimit-Reset": "0"},
+			wantReleased: 1,
+		},
+		{
+			name:         "last slot",
+			store:        &stubStore{open: 2, ok: true},
+			wantReached:  true,
+			wantStatus:   http.StatusOK,
+			wantHeaders:  map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "5"},
+			wantReleased: 1,
+		},
+		{
+			name:        "no slot",
+			store:       &stubStore{open: 2},
+			wantStatus:  http.StatusTooManyRequests,
+			wantHeaders: map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "5", "Retry-After": "5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, reached := serve(NewRateLimiter(cfg, tt.store).Streams())
+			if reached != tt.wantReached || rec.Code != tt.wantStatus {
+				t.Fatalf("reached = %v, status = %d, want %v, %d", reached, rec.Code, tt.wantReached, tt.wantStatus)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if tt.store.released != tt.wantReleased {
+				t.Errorf("released %d slots, want %d", tt.store.released, tt.wantReleased)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store drops refilled buckets.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// MemoryStore keeps rate limit state in memory. Limits are enforced per
+// replica.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	slots     map[string]int
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   make(map[string]*bucket),
+		slots:     make(map[string]int),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	var res Result
+	b.tokens, res = limit.Take(b.tokens, now.Sub(b.updated))
+	b.updated, b.limit = now, limit
+	return res, nil
+}
+
+// sweep drops the buckets that have refilled, which behave exactly like
+// missing ones, so that idle clients do not accumulate.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if b.limit.full(b.tokens, now.Sub(b.updated)) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (s *MemoryStore) Acquire(_ context.Context, key string, limit int) (func(), int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open := s.slots[key]
+	if open >= limit {
+		return nil, open, false, nil
+	}
+	s.slots[key] = open + 1
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.slots[key]--; s.slots[key] <= 0 {
+				delete(s.slots, key)
+			}
+		})
+	}
+	return release, open + 1, true, nil
+}
@@ -0,0 +1,76 @@
+// Package ratelimit implements token-bucket rate limits and concurrency
+// limits over pluggable storage.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+// Limit is a token bucket holding up to Burst tokens, refilled at Rate
+// tokens per second. Every request takes one token.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// FromConfig converts a configured rate limit into a Limit.
+func FromConfig(c config.RateLimit) Limit {
+	return Limit{Rate: c.PerMinute / 60, Burst: c.Burst}
+}
+
+// Enabled reports whether the limit applies at all.
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	Allowed bool
+	// Limit is the bucket size and Remaining the whole tokens left in it.
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next token, if not Allowed.
+	RetryAfter time.Duration
+}
+
+// Take takes a token from a bucket holding tokens that was last updated
+// elapsed ago. It returns the tokens left in the bucket.
+func (l Limit) Take(tokens float64, elapsed time.Duration) (float64, Result) {
+	tokens = min(float64(l.Burst), tokens+elapsed.Seconds()*l.Rate)
+
+	res := Result{Limit: l.Burst}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - tokens) / l.Rate)
+	}
+	res.Remaining = int(math.Floor(tokens))
+	res.Reset = seconds((float64(l.Burst) - tokens) / l.Rate)
+	return tokens, res
+}
+
+// full reports whether a bucket holding tokens elapsed ago has refilled.
+func (l Limit) full(tokens float64, elapsed time.Duration) bool {
+	return tokens+elapsed.Seconds()*l.Rate >= float64(l.Burst)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Store keeps rate limit state. Keys identify a limit and a client.
+type Store interface {
+	// Take takes a token from the bucket of key.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+	// Acquire takes one of limit concurrency slots of key. It reports false
+	// if all of them are taken; otherwise release frees the slot. open is
+	// the number of slots taken, including the new one.
+	Acquire(ctx context.Context, key string, limit int) (release func(), open int, ok bool, err error)
+}
@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+func TestLimitTake(t *testing.T) {
+	// One token every 2 seconds, up to 3.
+	limit := Limit{Rate: 0.5, Burst: 3}
+
+	tests := []struct {
+		name       string
+		tokens     float64
+		elapsed    time.Duration
+		wantTokens float64
+		want       Result
+	}{
+		{
+			name:       "full bucket",
+			tokens:     3,
+			wantTokens: 2,
+			want:       Result{Allowed: true, Limit: 3, Remaining: 2, Reset: 2 * time.Second},
+		},
+		{
+			name:       "last token",
+			tokens:     1,
+			wantTokens: 0,
+			want:       Result{Allowed: true, Limit: 3, Remaining: 0, Reset: 6 * time.Second},
+		},
+		{
+			name:       "empty bucket",
+			tokens:     0,
+			wantTokens: 0,
+			want:       Result{Limit: 3, Remaining: 0, Reset: 6 * time.Second, RetryAfter: 2 * time.Second},
+		},
+		{
+			name:       "partial token",
+			tokens:     0.5,
+			wantTokens: 0.5,
+			want:       Result{Limit: 3, Remaining: 0, Reset: 5 * time.Second, RetryAfter: time.Second},
+		},
+		{
+			name:       "refilled",
+			tokens:     0,
+			elapsed:    3 * time.Second,
+			wantTokens: 0.5,
+			want:       Result{Allowed: true, Limit: 3, Remaining: 0, Reset: 5 * time.Second},
+		},
+		{
+			name:       "refill capped at burst",
+			tokens:     1,
+			elapsed:    time.Hour,
+			wantTokens: 2,
+			want:       Result{Allowed: true, Limit: 3, Remaining: 2, Reset: 2 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, res := limit.Take(tt.tokens, tt.elapsed)
+			if tokens != tt.wantTokens {
+				t.Errorf("tokens = %v, want %v", tokens, tt.wantTokens)
+			}
+			if res != tt.want {
+				t.Errorf("result = %+v, want %+v", res, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitEnabled(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		want  bool
+	}{
+		{Limit{Rate: 1, Burst: 1}, true},
+		{Limit{Rate: 0, Burst: 1}, false},
+		{Limit{Rate: 1, Burst: 0}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.limit.Enabled(); got != tt.want {
+			t.Errorf("%+v.Enabled() = %v, want %v", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	if got, want := FromConfig(config.RateLimit{PerMinute: 120, Burst: 10}), (Limit{Rate: 2, Burst: 10}); got != want {
+		t.Fatalf("FromConfig = %+v, want %+v", got, want)
+	}
+}
+
+// fakeClock is a manually advanced clock for the memory store.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestStore() (*MemoryStore, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewMemoryStore()
+	s.now = clock.now
+	s.lastSweep = clock.t
+	return s, clock
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newTestStore()
+	limit := Limit{Rate: 1, Burst: 2}
+
+	take := func(key string) Result {
+		t.Helper()
+		res, err := s.Take(ctx, key, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// The burst is allowed at once, then requests wait for the refill.
+	for i := range 2 {
+		if res := take("a"); !res.Allowed || res.Remaining != 1-i {
+			t.Fatalf("request %d = %+v, want allowed with %d remaining", i, res, 1-i)
+		}
+	}
+	if res := take("a"); res.Allowed || res.RetryAfter != time.Second || res.Reset != 2*time.Second {
+		t.Fatalf("over burst = %+v, want rejected, retry after 1s, reset 2s", res)
+	}
+
+	// Other keys have their own bucket.
+	if res := take("b"); !res.Allowed {
+		t.Fatalf("other key = %+v, want allowed", res)
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if res := take("a"); res.Allowed || res.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("half refilled = %+v, want rejected, retry after 500ms", res)
+	}
+	clock.advance(500 * time.Millisecond)
+	if res := take("a"); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("refilled = %+v, want allowed with 0 remaining", res)
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newTestStore()
+	limit := Limit{Rate: 1, Burst: 2}
+
+	if _, err := s.Take(ctx, "idle", limit); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(sweepInterval)
+	if _, err := s.Take(ctx, "active", limit); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.buckets["idle"]; ok {
+		t.Fatal("refilled bucket was not swept")
+	}
+	if _, ok := s.buckets["active"]; !ok {
+		t.Fatal("active bucket was swept")
+	}
+}
+
+func TestMemoryStoreAcquire(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore()
+
+	release1, open, ok, err := s.Acquire(ctx, "k", 2)
+	if err != nil || !ok || open != 1 {
+		t.Fatalf("first Acquire = %d %v %v, want 1 slot", open, ok, err)
+	}
+	release2, open, ok, _ := s.Acquire(ctx, "k", 2)
+	if !ok || open != 2 {
+		t.Fatalf("second Acquire = %d %v, want 2 slots", open, ok)
+	}
+	if _, open, ok, _ := s.Acquire(ctx, "k", 2); ok || open != 2 {
+		t.Fatalf("third Acquire = %d %v, want rejected with 2 open", open, ok)
+	}
+
+	release1()
+	release1() // releasing twice frees one slot only
+	if _, open, ok, _ := s.Acquire(ctx, "k", 2); !ok || open != 2 {
+		t.Fatalf("Acquire after release = %d %v, want 2 slots", open, ok)
+	}
+	release2()
+}
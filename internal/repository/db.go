@@ -5,7 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io/fs"
-	"sort"
+	"log"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 
@@ -32,33 +32,28 @@ func NewPool(ctx context.Context, databaseURL string) (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
-// RunMigrations executes all SQL migrations from the embedded file system.
-// Since we are using basic execution, migration scripts must be idempotent
-// (e.g., using "IF NOT EXISTS").
+// RunMigrations applies all pending migrations embedded in db.MigrationsFS.
+// See Migrator for how applied migrations are tracked. Databases migrated
+// before schema_migrations existed re-run the first, idempotent migrations
+// once and are tracked from then on.
 func RunMigrations(ctx context.Context, pool *pgxpool.Pool) error {
-	entries, err := fs.ReadDir(db.MigrationsFS, "migrations")
+	migrator, err := NewMigrator(pool, MigrationFiles())
 	if err != nil {
-		return fmt.Errorf("failed to read migrations directory: %w", err)
+		return err
 	}
-
-	var filenames []string
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			filenames = append(filenames, entry.Name())
-		}
+	applied, err := migrator.Up(ctx)
+	for _, m := range applied {
+		log.Printf("Applied migration %03d_%s", m.Version, m.Name)
 	}
-	sort.Strings(filenames)
-
-	for _, filename := range filenames {
-		content, err := db.MigrationsFS.ReadFile("migrations/" + filename)
-		if err != nil {
-			return fmt.Errorf("failed to read migration %s: %w", filename, err)
-		}
+	return err
+}
 
-		if _, err := pool.Exec(ctx, string(content)); err != nil {
-			return fmt.Errorf("failed to execute migration %s: %w", filename, err)
-		}
+// MigrationFiles returns the embedded migration files.
+func MigrationFiles() fs.FS {
+	sub, err := fs.Sub(db.MigrationsFS, "migrations")
+	if err != nil {
+		// fs.Sub only fails for an invalid path, which is a constant here.
+		panic(err)
 	}
-
-	return nil
+	return sub
 }
@@ -0,0 +1,294 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrationLockKey is the advisory lock held while migrating, so replicas
+// starting at the same time apply migrations one after another.
+const migrationLockKey int64 = 0x6d69677261746521 // "migrate!"
+
+// migrationFilePattern matches "NNN_name.sql" and "NNN_name.down.sql".
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(.+?)(\.down)?\.sql$`)
+
+// Migration is a versioned schema change read from a migration file and its
+// optional ".down.sql" counterpart.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	// Down reverts Up. It is empty when the migration cannot be rolled back.
+	Down string
+	// Checksum is the SHA-256 of Up, used to detect edits of a migration
+	// that was already applied.
+	Checksum string
+}
+
+// MigrationStatus describes a migration file or an applied migration.
+type MigrationStatus struct {
+	Version int64
+	Name    string
+	// AppliedAt is nil for a pending migration.
+	AppliedAt *time.Time
+	// Modified is true when the file changed after it was applied.
+	Modified bool
+	// Missing is true when the migration was applied but its file no longer
+	// exists (e.g. it was applied by a newer build).
+	Missing bool
+}
+
+// ChecksumMismatchError is returned when an applied migration's file was
+// edited. Applied migrations must never change; add a new one instead.
+type ChecksumMismatchError struct {
+	Version int64
+	Name    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("migration %03d_%s was modified after it was applied", e.Version, e.Name)
+}
+
+// appliedMigration is a row of the schema_migrations table.
+type appliedMigration struct {
+	Version   int64
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// Migrator applies and reverts migrations, recording applied versions and
+// checksums in the schema_migrations table. Each migration runs in its own
+// transaction.
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+// NewMigrator creates a Migrator for the migration files at the root of fsys.
+func NewMigrator(pool *pgxpool.Pool, fsys fs.FS) (*Migrator, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: migrations}, nil
+}
+
+// LoadMigrations reads the migration files at the root of fsys, ordered by
+// version.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version %s: %w", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("duplicate migration version %d: %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] != "" {
+			m.Down = string(content)
+			continue
+		}
+		if m.Up != "" {
+			return nil, fmt.Errorf("duplicate migration version %d", version)
+		}
+		sum := sha256.Sum256(content)
+		m.Up = string(content)
+		m.Checksum = hex.EncodeToString(sum[:])
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %03d_%s has a down file but no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	return migrations, nil
+}
+
+// Up applies all pending migrations in version order and returns them. It
+// fails without applying anything if an applied migration was modified.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn, done map[int64]appliedMigration) error {
+		for _, mig := range m.migrations {
+			if row, ok := done[mig.Version]; ok && row.Checksum != mig.Checksum {
+				return &ChecksumMismatchError{Version: mig.Version, Name: mig.Name}
+			}
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := done[mig.Version]; ok {
+				continue
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, mig.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx,
+					`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+					mig.Version, mig.Name, mig.Checksum,
+				)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %03d_%s: %w", mig.Version, mig.Name, err)
+			}
+			applied = append(applied, mig)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the n most recently applied migrations, newest first, and
+// returns them. A migration without a down file stops the rollback.
+func (m *Migrator) Down(ctx context.Context, n int) ([]Migration, error) {
+	byVersion := make(map[int64]Migration, len(m.migrations))
+	for _, mig := range m.migrations {
+		byVersion[mig.Version] = mig
+	}
+
+	var reverted []Migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn, done map[int64]appliedMigration) error {
+		versions := make([]int64, 0, len(done))
+		for v := range done {
+			versions = append(versions, v)
+		}
+		slices.SortFunc(versions, func(a, b int64) int { return cmp.Compare(b, a) })
+
+		for _, v := range versions[:min(n, len(versions))] {
+			mig, ok := byVersion[v]
+			if !ok {
+				return fmt.Errorf("cannot revert migration %03d_%s: file not found", v, done[v].Name)
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("cannot revert migration %03d_%s: no down migration", mig.Version, mig.Name)
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, mig.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to revert migration %03d_%s: %w", mig.Version, mig.Name, err)
+			}
+			reverted = append(reverted, mig)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status reports every known migration, applied or pending, in version order.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(ctx, func(_ *pgxpool.Conn, done map[int64]appliedMigration) error {
+		for _, mig := range m.migrations {
+			st := MigrationStatus{Version: mig.Version, Name: mig.Name}
+			if row, ok := done[mig.Version]; ok {
+				st.AppliedAt = &row.AppliedAt
+				st.Modified = row.Checksum != mig.Checksum
+				delete(done, mig.Version)
+			}
+			statuses = append(statuses, st)
+		}
+		for _, row := range done {
+			statuses = append(statuses, MigrationStatus{
+				Version:   row.Version,
+				Name:      row.Name,
+				AppliedAt: &row.AppliedAt,
+				Missing:   true,
+			})
+		}
+		return nil
+	})
+	slices.SortFunc(statuses, func(a, b MigrationStatus) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	return statuses, err
+}
+
+// withLock runs fn on a dedicated connection holding the migration advisory
+// lock, passing the migrations applied so far by version.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn, applied map[int64]appliedMigration) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		// Closing the connection releases the lock in case it was granted.
+		conn.Conn().Close(context.WithoutCancel(ctx))
+		return fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			conn.Conn().Close(context.WithoutCancel(ctx))
+		}
+	}()
+
+	_, err = conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    BIGINT      PRIMARY KEY,
+			name       TEXT        NOT NULL,
+			checksum   TEXT        NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	rows, err := conn.Query(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+	applied, err := pgx.CollectRows(rows, pgx.RowToStructByPos[appliedMigration])
+	if err != nil {
+		return fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+
+	done := make(map[int64]appliedMigration, len(applied))
+	for _, row := range applied {
+		done[row.Version] = row
+	}
+	return fn(conn, done)
+}
@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/FPT-OJT/minstant-ai.git/db"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"010_add_index.sql":          {Data: []byte("CREATE INDEX i ON t(c);")},
+		"002_create_t.sql":           {Data: []byte("CREATE TABLE t (c INT);")},
+		"002_create_t.down.sql":      {Data: []byte("DROP TABLE t;")},
+		"001_init.sql":               {Data: []byte("SELECT 1;")},
+		"README.md":                  {Data: []byte("not a migration")},
+		"notes.sql":                  {Data: []byte("not a migration either")},
+		"003_nested.sql/ignored.sql": {Data: []byte("SELECT 1;")},
+	}
+
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+
+	want := []struct {
+		version int64
+		name    string
+		down    string
+	}{
+		{1, "init", ""},
+		{2, "create_t", "DROP TABLE t;"},
+		{10, "add_index", ""},
+	}
+	if len(migrations) != len(want) {
+		t.Fatalf("got %d migrations, want %d: %+v", len(migrations), len(want), migrations)
+	}
+	for i, w := range want {
+		m := migrations[i]
+		if m.Version != w.version || m.Name != w.name || m.Down != w.down {
+			t.Errorf("migration %d = %d %s down %q, want %d %s down %q", i, m.Version, m.Name, m.Down, w.version, w.name, w.down)
+		}
+		if m.Up == "" || len(m.Checksum) != 64 {
+			t.Errorf("migration %d has up %q and checksum %q", i, m.Up, m.Checksum)
+		}
+	}
+}
+
+func TestLoadMigrationsChecksumIgnoresDown(t *testing.T) {
+	up := &fstest.MapFile{Data: []byte("CREATE TABLE t (c INT);")}
+	withoutDown, err := LoadMigrations(fstest.MapFS{"001_t.sql": up})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withDown, err := LoadMigrations(fstest.MapFS{"001_t.sql": up, "001_t.down.sql": {Data: []byte("DROP TABLE t;")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withoutDown[0].Checksum != withDown[0].Checksum {
+		t.Fatal("adding a down file changed the checksum")
+	}
+}
+
+func TestLoadMigrationsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+		want string
+	}{
+		{
+			name: "duplicate version",
+			fsys: fstest.MapFS{
+				"001_a.sql": {Data: []byte("SELECT 1;")},
+				"001_b.sql": {Data: []byte("SELECT 2;")},
+			},
+			want: "duplicate migration version 1",
+		},
+		{
+			name: "duplicate version with padding",
+			fsys: fstest.MapFS{
+				"001_a.sql": {Data: []byte("SELECT 1;")},
+				"01_a.sql":  {Data: []byte("SELECT 2;")},
+			},
+			want: "duplicate migration version 1",
+		},
+		{
+			name: "down file named differently",
+			fsys: fstest.MapFS{
+				"001_a.sql":      {Data: []byte("SELECT 1;")},
+				"001_b.down.sql": {Data: []byte("SELECT 2;")},
+			},
+			want: "duplicate migration version 1",
+		},
+		{
+			name: "down file without up file",
+			fsys: fstest.MapFS{
+				"001_a.sql":      {Data: []byte("SELECT 1;")},
+				"002_b.down.sql": {Data: []byte("SELECT 2;")},
+			},
+			want: "migration 002_b has a down file but no up file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadMigrations(tt.fsys)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("LoadMigrations error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestEmbeddedMigrations checks that the shipped migrations load, are
+// numbered without gaps and can all be reverted.
+func TestEmbeddedMigrations(t *testing.T) {
+	fsys, err := fs.Sub(db.MigrationsFS, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("migration %03d_%s has version %d, want %d", m.Version, m.Name, m.Version, i+1)
+		}
+		if m.Down == "" {
+			t.Errorf("migration %03d_%s has no down file", m.Version, m.Name)
+		}
+	}
+}
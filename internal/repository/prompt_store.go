@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PromptRecord is a stored override of a built-in prompt template.
+type PromptRecord struct {
+	Name      string
+	Template  string
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+// PgPromptStore persists prompt template overrides in the chat database.
+type PgPromptStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPgPromptStore creates a new PostgreSQL-backed prompt store.
+func NewPgPromptStore(pool *pgxpool.Pool) *PgPromptStore {
+	return &PgPromptStore{pool: pool}
+}
+
+// Prompt returns the override of the named prompt. It reports false if the
+// prompt is not overridden.
+func (s *PgPromptStore) Prompt(ctx context.Context, name string) (string, bool, error) {
+	rec, err := s.GetPrompt(ctx, name)
+	if err != nil || rec == nil {
+		return "", false, err
+	}
+	return rec.Template, true, nil
+}
+
+// GetPrompt returns the override of the named prompt, or nil if it is not
+// overridden.
+func (s *PgPromptStore) GetPrompt(ctx context.Context, name string) (*PromptRecord, error) {
+	var rec PromptRecord
+	err := s.pool.QueryRow(ctx,
+		`SELECT name, template, updated_by, updated_at FROM chat_prompts WHERE name = $1`, name,
+	).Scan(&rec.Name, &rec.Template, &rec.UpdatedBy, &rec.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("prompt store get: %w", err)
+	}
+	return &rec, nil
+}
+
+// SetPrompt stores the override of the named prompt.
+func (s *PgPromptStore) SetPrompt(ctx context.Context, name, template, updatedBy string) (*PromptRecord, error) {
+	rec := PromptRecord{Name: name, Template: template, UpdatedBy: updatedBy}
+	err := s.pool.QueryRow(ctx,
+		`INSERT INTO chat_prompts (name, template, updated_by, updated_at)
+		 VALUES ($1, $2, $3, NOW())
+		 ON CONFLICT (name) DO UPDATE
+		 SET template = EXCLUDED.template,
+		     updated_by = EXCLUDED.updated_by,
+		     updated_at = NOW()
+		 RETURNING updated_at`,
+		name, template, updatedBy,
+	).Scan(&rec.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("prompt store set: %w", err)
+	}
+	return &rec, nil
+}
+
+// DeletePrompt removes the override of the named prompt, restoring the
+// built-in template.
+func (s *PgPromptStore) DeletePrompt(ctx context.Context, name string) error {
+	if _, err := s.pool.Exec(ctx, `DELETE FROM chat_prompts WHERE name = $1`, name); err != nil {
+		return fmt.Errorf("prompt store delete: %w", err)
+	}
+	return nil
+}
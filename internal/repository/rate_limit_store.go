@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/ratelimit"
+)
+
+// PgRateLimitStore keeps rate limit state in PostgreSQL so that limits are
+// shared by all replicas. Time is taken from the database clock.
+type PgRateLimitStore struct {
+	pool *pgxpool.Pool
+	// lease bounds how long a stream slot is held if it is never released.
+	lease time.Duration
+}
+
+// NewPgRateLimitStore creates a rate limit store backed by the given pool.
+func NewPgRateLimitStore(pool *pgxpool.Pool, streamLease time.Duration) *PgRateLimitStore {
+	return &PgRateLimitStore{pool: pool, lease: streamLease}
+}
+
+// Take takes a token from the bucket of key. The bucket row is locked for
+// the duration of the update.
+func (s *PgRateLimitStore) Take(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	var res ratelimit.Result
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO rate_limit_buckets (key, tokens) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`,
+			key, float64(limit.Burst),
+		)
+		if err != nil {
+			return err
+		}
+
+		var (
+			tokens  float64
+			elapsed time.Duration
+		)
+		err = tx.QueryRow(ctx,
+			`SELECT tokens, NOW() - updated_at FROM rate_limit_buckets WHERE key = $1 FOR UPDATE`, key,
+		).Scan(&tokens, &elapsed)
+		if err != nil {
+			return err
+		}
+
+		tokens, res = limit.Take(tokens, elapsed)
+		_, err = tx.Exec(ctx,
+			`UPDATE rate_limit_buckets SET tokens = $2, updated_at = NOW() WHERE key = $1`, key, tokens,
+		)
+		return err
+	})
+	if err != nil {
+		return ratelimit.Result{}, fmt.Errorf("rate limit take: %w", err)
+	}
+	return res, nil
+}
+
+// Acquire takes one of limit stream slots of key. Slots expire after the
+// store's lease if they are never released.
+func (s *PgRateLimitStore) Acquire(ctx context.Context, key string, limit int) (func(), int, bool, error) {
+	id := uuid.NewString()
+	var (
+		open     int
+		acquired bool
+	)
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		// Serialize slot changes of the key so concurrent requests cannot
+		// both take the last slot.
+		_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtextextended('rate_limit_stream:' || $1, 0))`, key)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM rate_limit_streams WHERE key = $1 AND expires_at < NOW()`, key)
+		if err != nil {
+			return err
+		}
+		if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM rate_limit_streams WHERE key = $1`, key).Scan(&open); err != nil {
+			return err
+		}
+		if open >= limit {
+			return nil
+		}
+		_, err = tx.Exec(ctx,
+			`INSERT INTO rate_limit_streams (id, key, expires_at) VALUES ($1, $2, NOW() + $3::interval)`,
+			id, key, s.lease,
+		)
+		open, acquired = open+1, err == nil
+		return err
+	})
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("rate limit acquire: %w", err)
+	}
+	if !acquired {
+		return nil, open, false, nil
+	}
+
+	release := func() {
+		// The request that held the slot has ended, so its context may be
+		// done already.
+		_, err := s.pool.Exec(context.WithoutCancel(ctx), `DELETE FROM rate_limit_streams WHERE id = $1`, id)
+		if err != nil {
+			log.Printf("rate limit: failed to release stream slot %s: %v", id, err)
+		}
+	}
+	return release, open, true, nil
+}
+
+// Prune deletes buckets idle for longer than idle, which behave like missing
+// ones once refilled, and expired stream slots.
+func (s *PgRateLimitStore) Prune(ctx context.Context, idle time.Duration) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM rate_limit_buckets WHERE updated_at < NOW() - $1::interval`, idle)
+	if err != nil {
+		return fmt.Errorf("rate limit prune buckets: %w", err)
+	}
+	_, err = s.pool.Exec(ctx, `DELETE FROM rate_limit_streams WHERE expires_at < NOW()`)
+	if err != nil {
+		return fmt.Errorf("rate limit prune streams: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// sessionLockLease is how long a session lock is held without being
+	// renewed. It bounds how long the sessions of a replica that died stay
+	// locked.
+	sessionLockLease = 30 * time.Second
+	// sessionLockRenewInterval is how often a held lock's lease is renewed.
+	sessionLockRenewInterval = sessionLockLease / 3
+	// sessionLockMinPoll and sessionLockMaxPoll bound the wait between
+	// attempts to take a busy lock.
+	sessionLockMinPoll = 100 * time.Millisecond
+	sessionLockMaxPoll = time.Second
+)
+
+// PgSessionLocker serializes chat turns per session across replicas using
+// lease rows in the chat_session_locks table. A connection is only used for
+// the statements taking, renewing and releasing a lease, so held and awaited
+// locks do not exhaust the pool shared with the rest of the chat database.
+type PgSessionLocker struct {
+	pool *pgxpool.Pool
+}
+
+// NewPgSessionLocker creates a session locker backed by the given pool.
+func NewPgSessionLocker(pool *pgxpool.Pool) *PgSessionLocker {
+	return &PgSessionLocker{pool: pool}
+}
+
+// TryLock takes the session's lock without waiting. It reports false if
+// another turn holds it.
+func (l *PgSessionLocker) TryLock(ctx context.Context, sessionID string) (unlock func(), ok bool, err error) {
+	holder := uuid.NewString()
+	ok, err = l.take(ctx, sessionID, holder)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return l.hold(ctx, sessionID, holder), true, nil
+}
+
+// Lock waits for the session's lock until it is free or ctx is done. Waiting
+// turns poll the lock, so they are not served in order.
+func (l *PgSessionLocker) Lock(ctx context.Context, sessionID string) (unlock func(), err error) {
+	holder := uuid.NewString()
+	poll := sessionLockMinPoll
+	for {
+		ok, err := l.take(ctx, sessionID, holder)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return l.hold(ctx, sessionID, holder), nil
+		}
+
+		select {
+		case <-time.After(poll):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("session lock: %w", ctx.Err())
+		}
+		poll = min(poll*2, sessionLockMaxPoll)
+	}
+}
+
+// take creates the session's lease for holder, or takes over an expired one.
+// It reports false if another holder's lease is still valid.
+func (l *PgSessionLocker) take(ctx context.Context, sessionID, holder string) (bool, error) {
+	tag, err := l.pool.Exec(ctx,
+		`INSERT INTO chat_session_locks (session_id, holder, expires_at)
+		 VALUES ($1, $2, NOW() + $3::interval)
+		 ON CONFLICT (session_id) DO UPDATE
+		 SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		 WHERE chat_session_locks.expires_at < NOW()`,
+		sessionID, holder, sessionLockLease,
+	)
+	if err != nil {
+		return false, fmt.Errorf("session lock: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// hold renews the lease of holder until the returned unlock function is
+// called, which releases it.
+func (l *PgSessionLocker) hold(ctx context.Context, sessionID, holder string) func() {
+	// The lock outlives the request that took it.
+	ctx = context.WithoutCancel(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(sessionLockRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tag, err := l.pool.Exec(ctx,
+					`UPDATE chat_session_locks SET expires_at = NOW() + $3::interval
+					 WHERE session_id = $1 AND holder = $2`,
+					sessionID, holder, sessionLockLease,
+				)
+				if err != nil {
+					log.Printf("failed to renew lock of session %s: %v", sessionID, err)
+				} else if tag.RowsAffected() == 0 {
+					log.Printf("lost lock of session %s", sessionID)
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		_, err := l.pool.Exec(ctx,
+			`DELETE FROM chat_session_locks WHERE session_id = $1 AND holder = $2`, sessionID, holder,
+		)
+		if err != nil {
+			log.Printf("failed to unlock session %s: %v", sessionID, err)
+		}
+	}
+}
@@ -3,16 +3,32 @@ package repository
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/firebase/genkit/go/core/x/session"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/FPT-OJT/minstant-ai.git/internal/ai/flow"
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
 )
 
+// SessionForbiddenError is returned when a session exists but belongs to a
+// different user than the one in the request context.
+type SessionForbiddenError struct {
+	SessionID string
+}
+
+func (e *SessionForbiddenError) Error() string {
+	return "session belongs to another user: " + e.SessionID
+}
+
 // PgSessionStore implements session.Store[flow.ChatState] backed by PostgreSQL.
-// It persists session data in the chat_sessions table using pgx.
+// It persists session data in the chat_sessions table using pgx. Every
+// operation is scoped to the authenticated user found in the context.
 type PgSessionStore struct {
 	pool *pgxpool.Pool
 }
@@ -22,27 +38,45 @@ func NewPgSessionStore(pool *pgxpool.Pool) *PgSessionStore {
 	return &PgSessionStore{pool: pool}
 }
 
-// Compile-time check that PgSessionStore implements session.Store.
-var _ session.Store[flow.ChatState] = (*PgSessionStore)(nil)
+// Compile-time checks that PgSessionStore implements session.Store and
+// flow.TitleStore.
+var (
+	_ session.Store[flow.ChatState] = (*PgSessionStore)(nil)
+	_ flow.TitleStore               = (*PgSessionStore)(nil)
+)
 
-// Get retrieves session data by ID. Returns nil if not found.
+// Get retrieves session data by ID. Returns nil if not found, and a
+// *SessionForbiddenError if the session is owned by another user.
 func (s *PgSessionStore) Get(ctx context.Context, sessionID string) (*session.Data[flow.ChatState], error) {
-	var dataJSON []byte
-	err := s.pool.QueryRow(ctx,
-		`SELECT data FROM chat_sessions WHERE session_id = $1`, sessionID,
-	).Scan(&dataJSON)
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("session store get: %w", err)
+	}
+
+	var (
+		dataJSON []byte
+		owned    bool
+		version  int64
+	)
+	err = s.pool.QueryRow(ctx,
+		`SELECT data, user_id = $2, version FROM chat_sessions WHERE session_id = $1`, sessionID, userID,
+	).Scan(&dataJSON, &owned, &version)
 	if err != nil {
-		// pgx returns no rows error; treat as not found.
-		if err.Error() == "no rows in result set" {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("session store get: %w", err)
 	}
 
+	if !owned {
+		return nil, &SessionForbiddenError{SessionID: sessionID}
+	}
+
 	var state flow.ChatState
 	if err := json.Unmarshal(dataJSON, &state); err != nil {
 		return nil, fmt.Errorf("session store get: failed to unmarshal state: %w", err)
 	}
+	state.Version = version
 
 	return &session.Data[flow.ChatState]{
 		ID:    sessionID,
@@ -50,23 +84,281 @@ func (s *PgSessionStore) Get(ctx context.Context, sessionID string) (*session.Da
 	}, nil
 }
 
-// Save persists session data, creating or updating as needed (UPSERT).
+// Save persists session data. A state at version 0 has never been saved and
+// creates the session, owned by the user in the context; if the session
+// already exists a *flow.SessionConflictError is returned, or a
+// *SessionForbiddenError if another user owns it. Any other state updates
+// the session only if it is owned by that user and its stored version still
+// equals data.State.Version, and its version is then incremented. Otherwise
+// a *SessionForbiddenError, a *flow.SessionConflictError or, if the session
+// was deleted, a *session.NotFoundError is returned.
 func (s *PgSessionStore) Save(ctx context.Context, sessionID string, data *session.Data[flow.ChatState]) error {
-	dataJSON, err := json.Marshal(data.State)
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return fmt.Errorf("session store save: %w", err)
+	}
+
+	// The version lives in its own column, not in the JSON state.
+	state := data.State
+	state.Version = 0
+	dataJSON, err := json.Marshal(state)
 	if err != nil {
 		return fmt.Errorf("session store save: failed to marshal state: %w", err)
 	}
 
+	var tag pgconn.CommandTag
+	if data.State.Version == 0 {
+		tag, err = s.pool.Exec(ctx,
+			`INSERT INTO chat_sessions (session_id, data, user_id)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT (session_id) DO NOTHING`,
+			sessionID, dataJSON, userID,
+		)
+	} else {
+		tag, err = s.pool.Exec(ctx,
+			`UPDATE chat_sessions
+			 SET data = $2, version = version + 1, updated_at = NOW()
+			 WHERE session_id = $1 AND user_id = $3 AND version = $4`,
+			sessionID, dataJSON, userID, data.State.Version,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("session store save: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return s.forbiddenOrConflict(ctx, sessionID, userID)
+	}
+
+	return nil
+}
+
+// SessionSummary describes a chat session without its conversation history.
+type SessionSummary struct {
+	ID        string
+	UserID    string
+	Title     *string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// SessionRecord is a chat session together with its persisted state.
+type SessionRecord struct {
+	SessionSummary
+	State flow.ChatState
+}
+
+// ListSessions returns up to limit sessions owned by userID, most recently
+// updated first, skipping the first offset sessions.
+func (s *PgSessionStore) ListSessions(ctx context.Context, userID string, limit, offset int) ([]SessionSummary, error) {
+	rows, err := s.pool.Query(ctx,
+		`SELECT session_id, title, created_at, updated_at
+		 FROM chat_sessions
+		 WHERE user_id = $1
+		 ORDER BY updated_at DESC, session_id
+		 LIMIT $2 OFFSET $3`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("session store list: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []SessionSummary{}
+	for rows.Next() {
+		sum := SessionSummary{UserID: userID}
+		if err := rows.Scan(&sum.ID, &sum.Title, &sum.CreatedAt, &sum.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("session store list: %w", err)
+		}
+		sessions = append(sessions, sum)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("session store list: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// GetSession returns a session owned by userID. It returns a
+// *session.NotFoundError if the session does not exist and a
+// *SessionForbiddenError if it belongs to another user.
+func (s *PgSessionStore) GetSession(ctx context.Context, userID, sessionID string) (*SessionRecord, error) {
+	rec, err := s.InspectSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if rec.UserID != userID {
+		return nil, &SessionForbiddenError{SessionID: sessionID}
+	}
+	return rec, nil
+}
+
+// InspectSessions returns up to limit sessions of any user, or only of
+// userID if it is set, most recently updated first, skipping the first
+// offset sessions. It is meant for operators.
+func (s *PgSessionStore) InspectSessions(ctx context.Context, userID string, limit, offset int) ([]SessionSummary, error) {
+	rows, err := s.pool.Query(ctx,
+		`SELECT session_id, user_id::text, title, created_at, updated_at
+		 FROM chat_sessions
+		 WHERE $1 = '' OR user_id::text = $1
+		 ORDER BY updated_at DESC, session_id
+		 LIMIT $2 OFFSET $3`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("session store inspect: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []SessionSummary{}
+	for rows.Next() {
+		var sum SessionSummary
+		if err := rows.Scan(&sum.ID, &sum.UserID, &sum.Title, &sum.CreatedAt, &sum.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("session store inspect: %w", err)
+		}
+		sessions = append(sessions, sum)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("session store inspect: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// InspectSession returns a session of any user. It returns a
+// *session.NotFoundError if it does not exist. It is meant for operators.
+func (s *PgSessionStore) InspectSession(ctx context.Context, sessionID string) (*SessionRecord, error) {
+	var (
+		rec      SessionRecord
+		dataJSON []byte
+	)
+	err := s.pool.QueryRow(ctx,
+		`SELECT session_id, user_id::text, title, created_at, updated_at, data
+		 FROM chat_sessions WHERE session_id = $1`, sessionID,
+	).Scan(&rec.ID, &rec.UserID, &rec.Title, &rec.CreatedAt, &rec.UpdatedAt, &dataJSON)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, &session.NotFoundError{SessionID: sessionID}
+		}
+		return nil, fmt.Errorf("session store get session: %w", err)
+	}
+
+	if err := json.Unmarshal(dataJSON, &rec.State); err != nil {
+		return nil, fmt.Errorf("session store get session: failed to unmarshal state: %w", err)
+	}
+
+	return &rec, nil
+}
+
+// UpdateTitle sets the title of a session owned by userID.
+func (s *PgSessionStore) UpdateTitle(ctx context.Context, userID, sessionID, title string) error {
+	tag, err := s.pool.Exec(ctx,
+		`UPDATE chat_sessions SET title = $3, updated_at = NOW()
+		 WHERE session_id = $1 AND user_id = $2`,
+		sessionID, userID, title,
+	)
+	if err != nil {
+		return fmt.Errorf("session store update title: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return s.missingOrForbidden(ctx, sessionID)
+	}
+	return nil
+}
+
+// SetTitleIfEmpty stores a generated title for a session owned by the user in
+// the context, unless the session already has a title.
+func (s *PgSessionStore) SetTitleIfEmpty(ctx context.Context, sessionID, title string) error {
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return fmt.Errorf("session store set title: %w", err)
+	}
+
 	_, err = s.pool.Exec(ctx,
-		`INSERT INTO chat_sessions (session_id, data, user_id)
-		 VALUES ($1, $2, '00000000-0000-0000-0000-000000000000')
-		 ON CONFLICT (session_id) DO UPDATE
-		 SET data = $2, updated_at = NOW()`,
-		sessionID, dataJSON,
+		`UPDATE chat_sessions SET title = $3
+		 WHERE session_id = $1 AND user_id = $2 AND title IS NULL`,
+		sessionID, userID, title,
 	)
 	if err != nil {
-		return fmt.Errorf("session store save: %w", err)
+		return fmt.Errorf("session store set title: %w", err)
 	}
+	return nil
+}
 
+// DeleteSession removes a session owned by userID.
+func (s *PgSessionStore) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	tag, err := s.pool.Exec(ctx,
+		`DELETE FROM chat_sessions WHERE session_id = $1 AND user_id = $2`,
+		sessionID, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("session store delete: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return s.missingOrForbidden(ctx, sessionID)
+	}
+	return nil
+}
+
+// missingOrForbidden explains why a user-scoped write matched no rows: the
+// session either does not exist or is owned by someone else.
+func (s *PgSessionStore) missingOrForbidden(ctx context.Context, sessionID string) error {
+	var exists bool
+	err := s.pool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM chat_sessions WHERE session_id = $1)`, sessionID,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("session store: %w", err)
+	}
+	if exists {
+		return &SessionForbiddenError{SessionID: sessionID}
+	}
+	return &session.NotFoundError{SessionID: sessionID}
+}
+
+// CheckOwner returns a *SessionForbiddenError if the session exists and is
+// owned by another user than userID. A session that does not exist yet
+// passes, since saving it will make userID its owner.
+func (s *PgSessionStore) CheckOwner(ctx context.Context, userID, sessionID string) error {
+	var owned bool
+	err := s.pool.QueryRow(ctx,
+		`SELECT user_id = $2 FROM chat_sessions WHERE session_id = $1`, sessionID, userID,
+	).Scan(&owned)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("session store check owner: %w", err)
+	}
+	if !owned {
+		return &SessionForbiddenError{SessionID: sessionID}
+	}
 	return nil
 }
+
+// forbiddenOrConflict explains why a save wrote no row: the session is owned
+// by another user, it was deleted, or it exists at another version.
+func (s *PgSessionStore) forbiddenOrConflict(ctx context.Context, sessionID, userID string) error {
+	var owned bool
+	err := s.pool.QueryRow(ctx,
+		`SELECT user_id = $2 FROM chat_sessions WHERE session_id = $1`, sessionID, userID,
+	).Scan(&owned)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return &session.NotFoundError{SessionID: sessionID}
+		}
+		return fmt.Errorf("session store save: %w", err)
+	}
+	if !owned {
+		return &SessionForbiddenError{SessionID: sessionID}
+	}
+	return &flow.SessionConflictError{SessionID: sessionID}
+}
+
+// userIDFromContext returns the user ID of the caller's principal.
+func userIDFromContext(ctx context.Context) (string, error) {
+	userID, ok := auth.UserIDFromContext(ctx)
+	if !ok {
+		return "", errors.New("missing authenticated user in context")
+	}
+	return userID, nil
+}
@@ -0,0 +1,171 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UsageRecord is the token usage of a single chat turn, or of a summary or
+// title generated for it.
+type UsageRecord struct {
+	UserID    string
+	SessionID string
+	RunID     string
+	// Kind is "chat" for the answer, or "summary" or "title".
+	Kind         string
+	Model        string
+	InputTokens  int
+	OutputTokens int
+	TotalTokens  int
+	ModelCalls   int
+	ToolCalls    int
+}
+
+// UsageTotals sums the usage of a user's turns over a period, including
+// their summaries and titles.
+type UsageTotals struct {
+	// Turns counts the answered turns only.
+	Turns        int64
+	InputTokens  int64
+	OutputTokens int64
+	TotalTokens  int64
+	ModelCalls   int64
+	ToolCalls    int64
+}
+
+// UserQuota holds per-user quota overrides. A nil limit means the user's
+// plan quota applies.
+type UserQuota struct {
+	DailyTokens   *int64
+	MonthlyTokens *int64
+}
+
+// PgUsageStore persists token usage and per-user quotas in the chat
+// database.
+type PgUsageStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPgUsageStore creates a new PostgreSQL-backed usage store.
+func NewPgUsageStore(pool *pgxpool.Pool) *PgUsageStore {
+	return &PgUsageStore{pool: pool}
+}
+
+// RecordUsage stores a usage record.
+func (s *PgUsageStore) RecordUsage(ctx context.Context, rec UsageRecord) error {
+	_, err := s.pool.Exec(ctx,
+		`INSERT INTO chat_usage
+		   (user_id, session_id, run_id, kind, model, input_tokens, output_tokens, total_tokens, model_calls, tool_calls)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		rec.UserID, rec.SessionID, rec.RunID, rec.Kind, rec.Model,
+		rec.InputTokens, rec.OutputTokens, rec.TotalTokens, rec.ModelCalls, rec.ToolCalls,
+	)
+	if err != nil {
+		return fmt.Errorf("usage store record: %w", err)
+	}
+	return nil
+}
+
+// UsageSince sums the usage of userID's turns since the given time.
+func (s *PgUsageStore) UsageSince(ctx context.Context, userID string, since time.Time) (UsageTotals, error) {
+	var t UsageTotals
+	err := s.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FILTER (WHERE kind = 'chat'),
+		        COALESCE(SUM(input_tokens), 0),
+		        COALESCE(SUM(output_tokens), 0),
+		        COALESCE(SUM(total_tokens), 0),
+		        COALESCE(SUM(model_calls), 0),
+		        COALESCE(SUM(tool_calls), 0)
+		 FROM chat_usage
+		 WHERE user_id = $1 AND created_at >= $2`,
+		userID, since,
+	).Scan(&t.Turns, &t.InputTokens, &t.OutputTokens, &t.TotalTokens, &t.ModelCalls, &t.ToolCalls)
+	if err != nil {
+		return UsageTotals{}, fmt.Errorf("usage store sum: %w", err)
+	}
+	return t, nil
+}
+
+// UserQuota returns the quota overrides of userID; both limits are nil if
+// the user has none.
+func (s *PgUsageStore) UserQuota(ctx context.Context, userID string) (UserQuota, error) {
+	var q UserQuota
+	err := s.pool.QueryRow(ctx,
+		`SELECT daily_tokens, monthly_tokens FROM chat_user_quotas WHERE user_id = $1`, userID,
+	).Scan(&q.DailyTokens, &q.MonthlyTokens)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return UserQuota{}, fmt.Errorf("usage store quota: %w", err)
+	}
+	return q, nil
+}
+
+// UserUsageTotals is the usage of one user over a period.
+type UserUsageTotals struct {
+	UserID string
+	UsageTotals
+}
+
+// UsageByUser sums the usage of every user, or only of userID if it is set,
+// between from (inclusive) and to (exclusive), heaviest users first.
+func (s *PgUsageStore) UsageByUser(ctx context.Context, userID string, from, to time.Time) ([]UserUsageTotals, error) {
+	rows, err := s.pool.Query(ctx,
+		`SELECT user_id::text,
+		        COUNT(*) FILTER (WHERE kind = 'chat'),
+		        SUM(input_tokens),
+		        SUM(output_tokens),
+		        SUM(total_tokens),
+		        SUM(model_calls),
+		        SUM(tool_calls)
+		 FROM chat_usage
+		 WHERE ($1 = '' OR user_id::text = $1) AND created_at >= $2 AND created_at < $3
+		 GROUP BY user_id
+		 ORDER BY SUM(total_tokens) DESC, user_id`,
+		userID, from, to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("usage store report: %w", err)
+	}
+	defer rows.Close()
+
+	users := []UserUsageTotals{}
+	for rows.Next() {
+		var u UserUsageTotals
+		if err := rows.Scan(&u.UserID, &u.Turns, &u.InputTokens, &u.OutputTokens, &u.TotalTokens, &u.ModelCalls, &u.ToolCalls); err != nil {
+			return nil, fmt.Errorf("usage store report: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("usage store report: %w", err)
+	}
+
+	return users, nil
+}
+
+// SetUserQuota stores the quota overrides of userID. Nil limits fall back to
+// the user's plan quota; a user without overrides has no row at all.
+func (s *PgUsageStore) SetUserQuota(ctx context.Context, userID string, q UserQuota) error {
+	var err error
+	if q.DailyTokens == nil && q.MonthlyTokens == nil {
+		_, err = s.pool.Exec(ctx, `DELETE FROM chat_user_quotas WHERE user_id = $1`, userID)
+	} else {
+		_, err = s.pool.Exec(ctx,
+			`INSERT INTO chat_user_quotas (user_id, daily_tokens, monthly_tokens, updated_at)
+			 VALUES ($1, $2, $3, NOW())
+			 ON CONFLICT (user_id) DO UPDATE
+			 SET daily_tokens = EXCLUDED.daily_tokens,
+			     monthly_tokens = EXCLUDED.monthly_tokens,
+			     updated_at = NOW()`,
+			userID, q.DailyTokens, q.MonthlyTokens,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("usage store set quota: %w", err)
+	}
+	return nil
+}
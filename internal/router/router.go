@@ -2,6 +2,7 @@
 package router
 
 import (
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
 	"github.com/FPT-OJT/minstant-ai.git/internal/handler"
 	"github.com/FPT-OJT/minstant-ai.git/internal/middleware"
 	"github.com/FPT-OJT/minstant-ai.git/internal/service"
@@ -9,15 +10,51 @@ import (
 )
 
 // Setup registers all application routes and wires up handlers with their
-// dependencies. It receives a ChatService so the caller controls which
+// dependencies. It receives the services so the caller controls which
 // implementation (Genkit or Mock) is used — keeping the router loosely coupled.
-func Setup(r *chi.Mux, chatService service.ChatService) {
+// Only principals with one of operatorRoles reach the /admin routes.
+func Setup(r *chi.Mux, chatService service.ChatService, sessionService service.SessionService, usageService service.UsageService, adminService service.AdminService, limiter *middleware.RateLimiter, operatorRoles []string) {
 	// Handlers
 	chatHandler := handler.NewChatHandler(chatService)
+	sessionHandler := handler.NewSessionHandler(sessionService)
+	usageHandler := handler.NewUsageHandler(usageService)
+	adminHandler := handler.NewAdminHandler(adminService)
 
 	// Routes
 	aiRoute := chi.NewRouter()
 	aiRoute.Use(middleware.RequireAuth())
-	aiRoute.Post("/chat", chatHandler.HandleChat)
+	// A turn refused for too many open streams must not spend a chat token.
+	aiRoute.With(limiter.Streams(), limiter.ChatTurns()).Post("/chat", chatHandler.HandleChat)
+	aiRoute.With(limiter.ChatTurns()).Post("/chat/complete", chatHandler.HandleChatComplete)
+	aiRoute.With(limiter.Streams()).Get("/chat/runs/{id}/stream", chatHandler.HandleRunStream)
+	aiRoute.Post("/chat/runs/{id}/cancel", chatHandler.HandleCancelRun)
+	aiRoute.Get("/sessions", sessionHandler.ListSessions)
+	aiRoute.Get("/sessions/{id}", sessionHandler.GetSession)
+	aiRoute.Patch("/sessions/{id}", sessionHandler.RenameSession)
+	aiRoute.Delete("/sessions/{id}", sessionHandler.DeleteSession)
+	aiRoute.Get("/usage", usageHandler.GetUsage)
 	r.Mount("/", aiRoute)
+
+	// Operator routes, reserved to operator roles and each group gated by
+	// the permission it needs.
+	adminRoute := chi.NewRouter()
+	adminRoute.Use(middleware.RequireAuth(), middleware.RequireRole(operatorRoles...))
+	adminRoute.Group(func(r chi.Router) {
+		r.Use(middleware.RequirePermission(auth.PermInspectSessions))
+		r.Get("/sessions", adminHandler.ListSessions)
+		r.Get("/sessions/{id}", adminHandler.GetSession)
+	})
+	adminRoute.Group(func(r chi.Router) {
+		r.Use(middleware.RequirePermission(auth.PermManageUsage))
+		r.Get("/usage", adminHandler.GetUsage)
+		r.Put("/users/{id}/quota", adminHandler.SetUserQuota)
+	})
+	adminRoute.Group(func(r chi.Router) {
+		r.Use(middleware.RequirePermission(auth.PermManagePrompts))
+		r.Get("/prompts", adminHandler.ListPrompts)
+		r.Get("/prompts/{name}", adminHandler.GetPrompt)
+		r.Put("/prompts/{name}", adminHandler.SetPrompt)
+		r.Delete("/prompts/{name}", adminHandler.ResetPrompt)
+	})
+	r.Mount("/admin", adminRoute)
 }
@@ -0,0 +1,96 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+	"github.com/FPT-OJT/minstant-ai.git/internal/middleware"
+	"github.com/FPT-OJT/minstant-ai.git/internal/ratelimit"
+)
+
+// TestChatStreamLimitBeforeChatTurns checks that a turn refused for too many
+// open streams does not spend a chat token.
+func TestChatStreamLimitBeforeChatTurns(t *testing.T) {
+	const userID = "2f1d7a0e-8c1b-4f5e-9a43-1d2c3b4a5f60"
+	cfg := config.RateLimitConfig{
+		ChatTurns:  config.RateLimit{PerMinute: 1, Burst: 1},
+		MaxStreams: 1,
+	}
+	store := ratelimit.NewMemoryStore()
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, req.WithContext(auth.NewContext(req.Context(), &auth.Principal{UserID: userID})))
+		})
+	})
+	// The request is refused before reaching a handler, so no service is
+	// needed.
+	Setup(r, nil, nil, nil, nil, middleware.NewRateLimiter(cfg, store), nil)
+
+	ctx := context.Background()
+	release, _, ok, err := store.Acquire(ctx, "streams:user:"+userID, cfg.MaxStreams)
+	if err != nil || !ok {
+		t.Fatalf("Acquire = %v, %v", ok, err)
+	}
+	defer release()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/chat", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "Too many open streams") {
+		t.Fatalf("response = %d %s, want 429 for too many open streams", rec.Code, rec.Body)
+	}
+
+	res, err := store.Take(ctx, "chat:user:"+userID, ratelimit.FromConfig(cfg.ChatTurns))
+	if err != nil || !res.Allowed {
+		t.Fatalf("chat token was spent by the refused turn: %+v, %v", res, err)
+	}
+}
+
+// TestAdminRequiresOperatorRole checks that the /admin routes need both an
+// operator role and the permission of the route.
+func TestAdminRequiresOperatorRole(t *testing.T) {
+	tests := []struct {
+		name        string
+		principal   *auth.Principal
+		wantMessage string
+	}{
+		{
+			name:        "permission without operator role",
+			principal:   &auth.Principal{UserID: "u", Roles: []string{"viewer"}, Permissions: []string{auth.PermInspectSessions}},
+			wantMessage: "Missing required role",
+		},
+		{
+			name:        "operator role without permission",
+			principal:   &auth.Principal{UserID: "u", Roles: []string{"support"}, Permissions: []string{auth.PermManageUsage}},
+			wantMessage: "Missing required permission",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					next.ServeHTTP(w, req.WithContext(auth.NewContext(req.Context(), tt.principal)))
+				})
+			})
+			// The request is refused before reaching a handler, so no
+			// service is needed.
+			Setup(r, nil, nil, nil, nil, middleware.NewRateLimiter(config.RateLimitConfig{}, ratelimit.NewMemoryStore()), []string{"admin", "support"})
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/sessions", nil))
+			if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), tt.wantMessage) {
+				t.Fatalf("response = %d %s, want 403 %q", rec.Code, rec.Body, tt.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/ai/flow"
+	"github.com/FPT-OJT/minstant-ai.git/internal/repository"
+)
+
+// ErrPromptNotFound is returned for a name that is not a built-in prompt.
+var ErrPromptNotFound = errors.New("prompt not found")
+
+// InvalidPromptError is returned when a prompt template fails to render.
+type InvalidPromptError struct {
+	Err error
+}
+
+func (e *InvalidPromptError) Error() string {
+	return "invalid prompt template: " + e.Err.Error()
+}
+
+func (e *InvalidPromptError) Unwrap() error {
+	return e.Err
+}
+
+// AdminSessionSummary is a chat session entry of any user.
+type AdminSessionSummary struct {
+	SessionSummary
+	UserID string `json:"userId"`
+}
+
+// AdminSessionList is one page of chat sessions across users, newest first.
+type AdminSessionList struct {
+	Sessions []AdminSessionSummary `json:"sessions"`
+	Limit    int                   `json:"limit"`
+	Offset   int                   `json:"offset"`
+	HasMore  bool                  `json:"hasMore"`
+}
+
+// AdminSessionDetail is a chat session of any user with its messages.
+type AdminSessionDetail struct {
+	AdminSessionSummary
+	Messages []ChatMessage `json:"messages"`
+}
+
+// UserUsage is the usage of one user over a report period.
+type UserUsage struct {
+	UserID       string `json:"userId"`
+	Turns        int64  `json:"turns"`
+	InputTokens  int64  `json:"inputTokens"`
+	OutputTokens int64  `json:"outputTokens"`
+	TotalTokens  int64  `json:"totalTokens"`
+	ModelCalls   int64  `json:"modelCalls"`
+	ToolCalls    int64  `json:"toolCalls"`
+}
+
+// AdminUsageReport is the usage of users between From (inclusive) and To
+// (exclusive), heaviest users first.
+type AdminUsageReport struct {
+	From  time.Time   `json:"from"`
+	To    time.Time   `json:"to"`
+	Users []UserUsage `json:"users"`
+}
+
+// UserQuota overrides the plan quota of a user. Nil limits use the plan's.
+type UserQuota struct {
+	DailyTokens   *int64 `json:"dailyTokens"`
+	MonthlyTokens *int64 `json:"monthlyTokens"`
+}
+
+// Prompt is a prompt template and whether an operator has overridden the
+// built-in one.
+type Prompt struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	Custom   bool   `json:"custom"`
+	// UpdatedBy and UpdatedAt are set for custom prompts.
+	UpdatedBy string     `json:"updatedBy,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+// AdminSessionRepository is the session persistence required by
+// AdminService.
+type AdminSessionRepository interface {
+	InspectSessions(ctx context.Context, userID string, limit, offset int) ([]repository.SessionSummary, error)
+	InspectSession(ctx context.Context, sessionID string) (*repository.SessionRecord, error)
+}
+
+// AdminUsageRepository is the usage persistence required by AdminService.
+type AdminUsageRepository interface {
+	UsageByUser(ctx context.Context, userID string, from, to time.Time) ([]repository.UserUsageTotals, error)
+	SetUserQuota(ctx context.Context, userID string, q repository.UserQuota) error
+}
+
+// PromptRepository is the prompt persistence required by AdminService.
+type PromptRepository interface {
+	GetPrompt(ctx context.Context, name string) (*repository.PromptRecord, error)
+	SetPrompt(ctx context.Context, name, template, updatedBy string) (*repository.PromptRecord, error)
+	DeletePrompt(ctx context.Context, name string) error
+}
+
+// AdminService serves the operator endpoints. Access control is left to
+// the caller.
+type AdminService interface {
+	// ListSessions lists the sessions of every user, or only of userID if
+	// it is set.
+	ListSessions(ctx context.Context, userID string, limit, offset int) (*AdminSessionList, error)
+	GetSession(ctx context.Context, sessionID string) (*AdminSessionDetail, error)
+	// UsageByUser reports the usage of every user, or only of userID if it
+	// is set, between from and to.
+	UsageByUser(ctx context.Context, userID string, from, to time.Time) (*AdminUsageReport, error)
+	SetUserQuota(ctx context.Context, userID string, quota UserQuota) error
+	ListPrompts(ctx context.Context) ([]Prompt, error)
+	GetPrompt(ctx context.Context, name string) (*Prompt, error)
+	// SetPrompt overrides the named prompt after checking that the template
+	// renders.
+	SetPrompt(ctx context.Context, name, template, updatedBy string) (*Prompt, error)
+	// ResetPrompt restores the built-in template of the named prompt.
+	ResetPrompt(ctx context.Context, name string) (*Prompt, error)
+}
+
+type adminService struct {
+	sessions AdminSessionRepository
+	usage    AdminUsageRepository
+	prompts  PromptRepository
+}
+
+// NewAdminService creates an AdminService backed by the given repositories.
+func NewAdminService(sessions AdminSessionRepository, usage AdminUsageRepository, prompts PromptRepository) AdminService {
+	return &adminService{sessions: sessions, usage: usage, prompts: prompts}
+}
+
+func (s *adminService) ListSessions(ctx context.Context, userID string, limit, offset int) (*AdminSessionList, error) {
+	rows, hasMore, err := listSessionPage(ctx, s.sessions.InspectSessions, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &AdminSessionList{
+		Sessions: make([]AdminSessionSummary, 0, len(rows)),
+		Limit:    limit,
+		Offset:   offset,
+		HasMore:  hasMore,
+	}
+	for _, r := range rows {
+		list.Sessions = append(list.Sessions, AdminSessionSummary{SessionSummary: toSessionSummary(r), UserID: r.UserID})
+	}
+
+	return list, nil
+}
+
+func (s *adminService) GetSession(ctx context.Context, sessionID string) (*AdminSessionDetail, error) {
+	rec, err := s.sessions.InspectSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AdminSessionDetail{
+		AdminSessionSummary: AdminSessionSummary{SessionSummary: toSessionSummary(rec.SessionSummary), UserID: rec.UserID},
+		Messages:            toChatMessages(rec.State.History),
+	}, nil
+}
+
+func (s *adminService) UsageByUser(ctx context.Context, userID string, from, to time.Time) (*AdminUsageReport, error) {
+	rows, err := s.usage.UsageByUser(ctx, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AdminUsageReport{From: from, To: to, Users: make([]UserUsage, 0, len(rows))}
+	for _, r := range rows {
+		report.Users = append(report.Users, UserUsage{
+			UserID:       r.UserID,
+			Turns:        r.Turns,
+			InputTokens:  r.InputTokens,
+			OutputTokens: r.OutputTokens,
+			TotalTokens:  r.TotalTokens,
+			ModelCalls:   r.ModelCalls,
+			ToolCalls:    r.ToolCalls,
+		})
+	}
+	return report, nil
+}
+
+func (s *adminService) SetUserQuota(ctx context.Context, userID string, quota UserQuota) error {
+	return s.usage.SetUserQuota(ctx, userID, repository.UserQuota{
+		DailyTokens:   quota.DailyTokens,
+		MonthlyTokens: quota.MonthlyTokens,
+	})
+}
+
+func (s *adminService) ListPrompts(ctx context.Context) ([]Prompt, error) {
+	names := flow.PromptNames()
+	prompts := make([]Prompt, 0, len(names))
+	for _, name := range names {
+		p, err := s.GetPrompt(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		prompts = append(prompts, *p)
+	}
+	return prompts, nil
+}
+
+func (s *adminService) GetPrompt(ctx context.Context, name string) (*Prompt, error) {
+	def, ok := flow.DefaultPrompt(name)
+	if !ok {
+		return nil, ErrPromptNotFound
+	}
+	rec, err := s.prompts.GetPrompt(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return &Prompt{Name: name, Template: def}, nil
+	}
+	return toPrompt(rec), nil
+}
+
+func (s *adminService) SetPrompt(ctx context.Context, name, template, updatedBy string) (*Prompt, error) {
+	if _, ok := flow.DefaultPrompt(name); !ok {
+		return nil, ErrPromptNotFound
+	}
+	if err := flow.ValidatePrompt(name, template); err != nil {
+		return nil, &InvalidPromptError{Err: err}
+	}
+	rec, err := s.prompts.SetPrompt(ctx, name, template, updatedBy)
+	if err != nil {
+		return nil, err
+	}
+	return toPrompt(rec), nil
+}
+
+func (s *adminService) ResetPrompt(ctx context.Context, name string) (*Prompt, error) {
+	def, ok := flow.DefaultPrompt(name)
+	if !ok {
+		return nil, ErrPromptNotFound
+	}
+	if err := s.prompts.DeletePrompt(ctx, name); err != nil {
+		return nil, err
+	}
+	return &Prompt{Name: name, Template: def}, nil
+}
+
+func toPrompt(r *repository.PromptRecord) *Prompt {
+	return &Prompt{
+		Name:      r.Name,
+		Template:  r.Template,
+		Custom:    true,
+		UpdatedBy: r.UpdatedBy,
+		UpdatedAt: &r.UpdatedAt,
+	}
+}
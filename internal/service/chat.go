@@ -3,8 +3,15 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
 
 	"github.com/FPT-OJT/minstant-ai.git/internal/ai/flow"
+	"github.com/FPT-OJT/minstant-ai.git/internal/auth"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
 )
 
 type ChatInput struct {
@@ -13,52 +20,295 @@ type ChatInput struct {
 	FullName  *string  `json:"fullName"`
 	Lat       *float64 `json:"lat"`
 	Long      *float64 `json:"long"`
-	UserId    string   `json:"userId"`
+	// Principal is the verified caller. Its roles bound the generation
+	// settings and its plan selects the quota.
+	Principal *auth.Principal `json:"-"`
+	// Generation holds optional generation settings for the turn.
+	Generation GenerationOptions `json:"-"`
+}
+
+// ErrSessionBusy is returned by StartRun when another turn of the session is
+// running and busy sessions are configured to reject new turns.
+var ErrSessionBusy = errors.New("session is busy")
+
+// Event types emitted by a Run.
+const (
+	EventQueued    = "queued"
+	EventDelta     = "delta"
+	EventToolStart = "tool_start"
+	EventToolEnd   = "tool_end"
+	EventDone      = "done"
+	EventError     = "error"
+	EventCancelled = "cancelled"
+)
+
+// ChatUsage is the token usage of a chat turn.
+type ChatUsage struct {
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+	TotalTokens  int `json:"totalTokens"`
+	ModelCalls   int `json:"modelCalls"`
+	ToolCalls    int `json:"toolCalls"`
 }
 
+// ChatResult is the outcome of a completed chat turn.
+type ChatResult struct {
+	SessionID     string `json:"sessionId"`
+	Text          string `json:"text"`
+	UserMessageID string `json:"userMessageId"`
+	MessageID     string `json:"messageId"`
+	// Model is the model that generated the answer.
+	Model string    `json:"model"`
+	Usage ChatUsage `json:"usage"`
+}
+
+// ChatEvent is a single event of a streamed chat turn. Exactly one terminal
+// event (EventDone, EventError or EventCancelled) ends every run.
+type ChatEvent struct {
+	// ID is the sequential event ID within the run, starting at 1.
+	ID   int
+	Type string
+	// Text is the answer text for EventDelta.
+	Text string
+	// Tool and ToolRef identify the tool call for EventToolStart and
+	// EventToolEnd.
+	Tool    string
+	ToolRef string
+	// Result is set for EventDone, and for EventCancelled with the partial
+	// answer that was saved.
+	Result *ChatResult
+	// Err is set for EventError.
+	Err error
+}
+
+// ChatService generates chat turns. Each turn runs in the background,
+// independently of the request that started it, and clients consume its
+// events through Run.Subscribe.
 type ChatService interface {
-	GenerateResponse(ctx context.Context, input ChatInput) (<-chan string, <-chan error)
+	// StartRun starts generating a turn and returns its run.
+	StartRun(ctx context.Context, input ChatInput) (*Run, error)
+	// GetRun returns a run owned by userID, or ErrRunNotFound.
+	GetRun(runID, userID string) (*Run, error)
+	// CancelRun cancels the run with the given run ID, or the in-flight run
+	// of the session with that ID, if owned by userID.
+	CancelRun(id, userID string) (*Run, error)
 }
 
-type GenkitChatService struct{}
+// SessionLocker serializes the turns of a session, across replicas.
+type SessionLocker interface {
+	// TryLock takes the session's lock without waiting, reporting false if
+	// it is held by another turn.
+	TryLock(ctx context.Context, sessionID string) (unlock func(), ok bool, err error)
+	// Lock waits for the session's lock until it is free or ctx is done.
+	Lock(ctx context.Context, sessionID string) (unlock func(), err error)
+}
 
-func NewGenkitChatService() ChatService {
-	return &GenkitChatService{}
+// SessionOwnerChecker checks that a session may be used by a user.
+type SessionOwnerChecker interface {
+	// CheckOwner returns a *repository.SessionForbiddenError if the session
+	// exists and belongs to another user than userID.
+	CheckOwner(ctx context.Context, userID, sessionID string) error
 }
 
-func (s *GenkitChatService) GenerateResponse(ctx context.Context, input ChatInput) (<-chan string, <-chan error) {
-	chunks := make(chan string)
-	errCh := make(chan error, 1)
+type GenkitChatService struct {
+	cfg      config.ChatConfig
+	sessions SessionOwnerChecker
+	locker   SessionLocker
+	usage    UsageService
+	runs     *runRegistry
+}
+
+func NewGenkitChatService(cfg config.ChatConfig, sessions SessionOwnerChecker, locker SessionLocker, usage UsageService) ChatService {
+	return &GenkitChatService{
+		cfg:      cfg,
+		sessions: sessions,
+		locker:   locker,
+		usage:    usage,
+		runs:     newRunRegistry(cfg.RunRetention),
+	}
+}
+
+func (s *GenkitChatService) StartRun(ctx context.Context, input ChatInput) (*Run, error) {
+	caller := input.Principal
+	if caller == nil {
+		return nil, errors.New("chat input has no principal")
+	}
+	params, err := generationParams(s.cfg.Generation, caller.Roles, input.Generation)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.usage.CheckQuota(ctx, caller.UserID, caller.Plan); err != nil {
+		return nil, err
+	}
+
+	// Refuse foreign sessions before taking or queueing for their lock, so
+	// the caller gets a plain error and cannot hold up the owner's turns.
+	if err := s.sessions.CheckOwner(ctx, caller.UserID, input.SessionID); err != nil {
+		return nil, err
+	}
+
+	// Only one turn per session may run at a time, otherwise concurrent
+	// turns would overwrite each other's history.
+	unlock, locked, err := s.locker.TryLock(ctx, input.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !locked && s.cfg.BusySession == config.BusySessionReject {
+		return nil, ErrSessionBusy
+	}
+
+	// Generation must survive the client disconnecting, so it only keeps the
+	// request's values, not its cancellation. The flow and its tools read the
+	// caller from the context.
+	cancelCtx, cancel := context.WithCancelCause(auth.NewContext(context.WithoutCancel(ctx), caller))
+	runCtx, stop := context.WithTimeout(cancelCtx, s.cfg.RunTimeout)
+	run := newRun(uuid.NewString(), input.SessionID, caller.UserID, cancel)
+	s.runs.add(run)
 
 	go func() {
-		defer close(chunks)
-		defer close(errCh)
+		defer s.runs.finish(run)
+		defer cancel(nil)
+		defer stop()
+
+		if !locked {
+			run.append(ChatEvent{Type: EventQueued})
+			var err error
+			unlock, err = s.locker.Lock(runCtx, input.SessionID)
+			if err != nil {
+				s.fail(runCtx, run, err)
+				return
+			}
+		}
+		defer unlock()
+		s.runs.start(run)
 
-		input := flow.ChatFlowInput{
+		flowInput := flow.ChatFlowInput{
 			SessionID: input.SessionID,
 			Message:   input.ChatInput,
 			FullName:  input.FullName,
 			Lat:       input.Lat,
 			Long:      input.Long,
-			UserId:    input.UserId,
+			UserId:    caller.UserID,
+			RunID:     run.ID,
+			Config:    params,
 		}
 
-		for val, err := range flow.SmartWalletFlow.Stream(ctx, input) {
+		for val, err := range flow.SmartWalletFlow.Stream(runCtx, flowInput) {
 			if err != nil {
-				errCh <- err
+				s.fail(runCtx, run, err)
 				return
 			}
 			if val.Done {
-				break
-			}
-			select {
-			case <-ctx.Done():
-				errCh <- ctx.Err()
+				result := toChatResult(input.SessionID, val.Output)
+				s.end(runCtx, run, ChatEvent{Type: EventDone, Result: result}, result)
 				return
-			case chunks <- val.Stream:
 			}
+			run.append(toChatEvent(val.Stream))
 		}
 	}()
 
-	return chunks, errCh
+	return run, nil
+}
+
+func (s *GenkitChatService) GetRun(runID, userID string) (*Run, error) {
+	return s.runs.get(runID, userID)
+}
+
+func (s *GenkitChatService) CancelRun(id, userID string) (*Run, error) {
+	run, err := s.runs.get(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := run.Cancel(); err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// end records the usage of the turn in spent, if any, and appends its
+// terminal event ev. Usage is recorded first so that the next turn's quota
+// check sees it.
+func (s *GenkitChatService) end(runCtx context.Context, run *Run, ev ChatEvent, spent *ChatResult) {
+	if spent != nil {
+		if err := s.usage.RecordUsage(context.WithoutCancel(runCtx), run.UserID, run.ID, spent); err != nil {
+			log.Printf("failed to record usage of run %s: %v", run.ID, err)
+		}
+	}
+	run.append(ev)
+}
+
+// fail ends a run that stopped with err. The model calls it made before
+// failing, timing out or being cancelled are charged too.
+func (s *GenkitChatService) fail(runCtx context.Context, run *Run, err error) {
+	ev := runFailed(runCtx, run.SessionID, err)
+	if ev.Type == EventError {
+		log.Printf("run %s of session %s failed: %v", run.ID, run.SessionID, ev.Err)
+	}
+	s.end(runCtx, run, ev, spentBy(run.SessionID, err))
+}
+
+// runFailed returns the terminal event for a run that stopped with err: a
+// cancelled event if the user cancelled it, an error event otherwise. The
+// error of a run that timed out wraps context.DeadlineExceeded.
+func runFailed(runCtx context.Context, sessionID string, err error) ChatEvent {
+	if !errors.Is(context.Cause(runCtx), ErrRunCancelled) {
+		// Providers do not always report the deadline in their errors.
+		if errors.Is(runCtx.Err(), context.DeadlineExceeded) && !errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+		}
+		return ChatEvent{Type: EventError, Err: err}
+	}
+	// A run cancelled before streaming began has saved nothing.
+	result := &ChatResult{SessionID: sessionID}
+	var interrupted *flow.InterruptedError
+	if errors.As(err, &interrupted) {
+		result = toChatResult(sessionID, interrupted.Output)
+	}
+	return ChatEvent{Type: EventCancelled, Result: result}
+}
+
+// spentBy returns the output of a turn that stopped with err, or nil if it
+// stopped before making any model call.
+func spentBy(sessionID string, err error) *ChatResult {
+	var (
+		interrupted *flow.InterruptedError
+		failed      *flow.FailedError
+	)
+	switch {
+	case errors.As(err, &interrupted):
+		return toChatResult(sessionID, interrupted.Output)
+	case errors.As(err, &failed):
+		return toChatResult(sessionID, failed.Output)
+	default:
+		return nil
+	}
+}
+
+// toChatEvent converts a flow chunk into a service event.
+func toChatEvent(c flow.ChatChunk) ChatEvent {
+	switch c.Type {
+	case flow.ChunkToolStart:
+		return ChatEvent{Type: EventToolStart, Tool: c.Tool, ToolRef: c.ToolRef}
+	case flow.ChunkToolEnd:
+		return ChatEvent{Type: EventToolEnd, Tool: c.Tool, ToolRef: c.ToolRef}
+	default:
+		return ChatEvent{Type: EventDelta, Text: c.Text}
+	}
+}
+
+func toChatResult(sessionID string, out flow.ChatFlowOutput) *ChatResult {
+	return &ChatResult{
+		SessionID:     sessionID,
+		Text:          out.Text,
+		UserMessageID: out.UserMessageID,
+		MessageID:     out.MessageID,
+		Model:         out.Model,
+		Usage: ChatUsage{
+			InputTokens:  out.Usage.InputTokens,
+			OutputTokens: out.Usage.OutputTokens,
+			TotalTokens:  out.Usage.TotalTokens,
+			ModelCalls:   out.Usage.ModelCalls,
+			ToolCalls:    out.Usage.ToolCalls,
+		},
+	}
 }
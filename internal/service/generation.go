@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/ai/flow"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+// ErrTierNotAllowed is returned by StartRun when the requested model tier is
+// not allowed for any of the user's roles.
+var ErrTierNotAllowed = errors.New("model tier not allowed")
+
+// GenerationOptions are optional client-requested generation settings for a
+// turn. Their ranges are validated by the handler; StartRun applies the
+// limits of the user's roles.
+type GenerationOptions struct {
+	Temperature     *float64
+	MaxOutputTokens *int
+	// Tier is config.ModelFast, config.ModelAccurate or empty.
+	Tier string
+}
+
+// limitsFor returns the most permissive limits among roles, or the default
+// limits if none of the roles has its own.
+func limitsFor(cfg config.GenerationConfig, roles []string) config.GenerationLimits {
+	var (
+		limits config.GenerationLimits
+		found  bool
+	)
+	for _, role := range roles {
+		l, ok := cfg.Roles[role]
+		if !ok {
+			continue
+		}
+		if !found {
+			limits, found = l, true
+			continue
+		}
+		limits.MaxTemperature = max(limits.MaxTemperature, l.MaxTemperature)
+		limits.MaxOutputTokens = max(limits.MaxOutputTokens, l.MaxOutputTokens)
+		for _, tier := range l.Tiers {
+			if !slices.Contains(limits.Tiers, tier) {
+				limits.Tiers = append(slices.Clip(limits.Tiers), tier)
+			}
+		}
+	}
+	if !found {
+		return cfg.Default
+	}
+	return limits
+}
+
+// generationParams clamps opts to the limits of roles. It returns
+// ErrTierNotAllowed if the requested tier is not allowed.
+func generationParams(cfg config.GenerationConfig, roles []string, opts GenerationOptions) (flow.GenerationParams, error) {
+	limits := limitsFor(cfg, roles)
+
+	if opts.Tier != "" && !slices.Contains(limits.Tiers, opts.Tier) {
+		return flow.GenerationParams{}, ErrTierNotAllowed
+	}
+	params := flow.GenerationParams{Tier: opts.Tier}
+	if opts.Temperature != nil {
+		t := min(*opts.Temperature, limits.MaxTemperature)
+		params.Temperature = &t
+	}
+	if opts.MaxOutputTokens != nil {
+		n := min(*opts.MaxOutputTokens, limits.MaxOutputTokens)
+		params.MaxOutputTokens = &n
+	}
+	return params, nil
+}
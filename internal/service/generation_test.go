@@ -0,0 +1,106 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+)
+
+var generationCfg = config.GenerationConfig{
+	Default: config.GenerationLimits{MaxTemperature: 1, MaxOutputTokens: 1000},
+	Roles: map[string]config.GenerationLimits{
+		"pro":     {MaxTemperature: 1.5, MaxOutputTokens: 4000, Tiers: []string{config.ModelFast}},
+		"analyst": {MaxTemperature: 0.5, MaxOutputTokens: 8000, Tiers: []string{config.ModelAccurate}},
+		"basic":   {MaxTemperature: 0.2, MaxOutputTokens: 500},
+	},
+}
+
+func TestLimitsFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles []string
+		want  config.GenerationLimits
+	}{
+		{"no roles", nil, generationCfg.Default},
+		{"unknown role", []string{"guest"}, generationCfg.Default},
+		{"single role", []string{"pro"}, generationCfg.Roles["pro"]},
+		{"role below default", []string{"basic"}, generationCfg.Roles["basic"]},
+		{"unknown role ignored", []string{"guest", "basic"}, generationCfg.Roles["basic"]},
+		{
+			"most permissive wins",
+			[]string{"pro", "analyst", "basic"},
+			config.GenerationLimits{MaxTemperature: 1.5, MaxOutputTokens: 8000, Tiers: []string{config.ModelFast, config.ModelAccurate}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := limitsFor(generationCfg, tt.roles)
+			if got.MaxTemperature != tt.want.MaxTemperature || got.MaxOutputTokens != tt.want.MaxOutputTokens || !slices.Equal(got.Tiers, tt.want.Tiers) {
+				t.Fatalf("limitsFor = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if tiers := generationCfg.Roles["pro"].Tiers; !slices.Equal(tiers, []string{config.ModelFast}) {
+		t.Fatalf("merging limits modified the config: pro tiers = %v", tiers)
+	}
+}
+
+func TestGenerationParams(t *testing.T) {
+	float := func(f float64) *float64 { return &f }
+	integer := func(n int) *int { return &n }
+
+	tests := []struct {
+		name      string
+		roles     []string
+		opts      GenerationOptions
+		wantTemp  *float64
+		wantMax   *int
+		wantError error
+	}{
+		{"nothing requested", nil, GenerationOptions{}, nil, nil, nil},
+		{"within default limits", nil, GenerationOptions{Temperature: float(0.7), MaxOutputTokens: integer(800)}, float(0.7), integer(800), nil},
+		{"clamped to default limits", nil, GenerationOptions{Temperature: float(2), MaxOutputTokens: integer(5000)}, float(1), integer(1000), nil},
+		{"clamped to role limits", []string{"pro"}, GenerationOptions{Temperature: float(2), MaxOutputTokens: integer(5000)}, float(1.5), integer(4000), nil},
+		{"zero temperature kept", []string{"basic"}, GenerationOptions{Temperature: float(0)}, float(0), nil, nil},
+		{"tier not allowed by default", nil, GenerationOptions{Tier: config.ModelFast}, nil, nil, ErrTierNotAllowed},
+		{"tier of another role", []string{"pro"}, GenerationOptions{Tier: config.ModelAccurate}, nil, nil, ErrTierNotAllowed},
+		{"tier allowed", []string{"pro"}, GenerationOptions{Tier: config.ModelFast}, nil, nil, nil},
+		{"tier allowed by any role", []string{"pro", "analyst"}, GenerationOptions{Tier: config.ModelAccurate}, nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := generationParams(generationCfg, tt.roles, tt.opts)
+			if !errors.Is(err, tt.wantError) {
+				t.Fatalf("error = %v, want %v", err, tt.wantError)
+			}
+			if err != nil {
+				return
+			}
+			if params.Tier != tt.opts.Tier {
+				t.Errorf("tier = %q, want %q", params.Tier, tt.opts.Tier)
+			}
+			if !equalPtr(params.Temperature, tt.wantTemp) {
+				t.Errorf("temperature = %v, want %v", deref(params.Temperature), deref(tt.wantTemp))
+			}
+			if !equalPtr(params.MaxOutputTokens, tt.wantMax) {
+				t.Errorf("max output tokens = %v, want %v", deref(params.MaxOutputTokens), deref(tt.wantMax))
+			}
+		})
+	}
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func deref[T any](p *T) any {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRunNotFound is returned when a run does not exist, has expired, or
+	// belongs to another user.
+	ErrRunNotFound = errors.New("run not found")
+	// ErrRunFinished is returned when cancelling a run that already ended.
+	ErrRunFinished = errors.New("run already finished")
+	// ErrRunCancelled is the cancellation cause of a run stopped on request.
+	ErrRunCancelled = errors.New("run cancelled by user")
+)
+
+// Run is a single chat turn generated in the background. Its events are
+// buffered with sequential IDs (starting at 1) so that a client which lost
+// its connection can resume the stream from the last event it received.
+type Run struct {
+	ID        string
+	SessionID string
+	UserID    string
+
+	mu      sync.Mutex
+	events  []ChatEvent
+	done    bool
+	changed chan struct{}
+	cancel  context.CancelCauseFunc
+}
+
+func newRun(id, sessionID, userID string, cancel context.CancelCauseFunc) *Run {
+	return &Run{
+		ID:        id,
+		SessionID: sessionID,
+		UserID:    userID,
+		changed:   make(chan struct{}),
+		cancel:    cancel,
+	}
+}
+
+// Cancel stops the run's generation. The partial answer is saved and the run
+// ends with an EventCancelled event. It returns ErrRunFinished if the run has
+// already ended.
+func (r *Run) Cancel() error {
+	if r.Done() {
+		return ErrRunFinished
+	}
+	r.cancel(ErrRunCancelled)
+	return nil
+}
+
+// append buffers ev with the next event ID and wakes up subscribers.
+// Events after the terminal event are dropped.
+func (r *Run) append(ev ChatEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done {
+		return
+	}
+	ev.ID = len(r.events) + 1
+	r.events = append(r.events, ev)
+	if isTerminal(ev.Type) {
+		r.done = true
+	}
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Done reports whether the run has produced its terminal event.
+func (r *Run) Done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done
+}
+
+// Subscribe returns a channel that replays the buffered events with an ID
+// greater than afterID and then delivers live events. The channel is closed
+// after the terminal event or when ctx is cancelled; cancelling ctx does not
+// stop the run itself.
+func (r *Run) Subscribe(ctx context.Context, afterID int) <-chan ChatEvent {
+	out := make(chan ChatEvent)
+
+	go func() {
+		defer close(out)
+
+		next := max(afterID, 0)
+		for {
+			r.mu.Lock()
+			var pending []ChatEvent
+			if next < len(r.events) {
+				pending = r.events[next:]
+			}
+			done, changed := r.done, r.changed
+			r.mu.Unlock()
+
+			for _, ev := range pending {
+				select {
+				case out <- ev:
+					next = ev.ID
+				case <-ctx.Done():
+					return
+				}
+			}
+			if done {
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// isTerminal reports whether an event type ends a run.
+func isTerminal(eventType string) bool {
+	return eventType == EventDone || eventType == EventError || eventType == EventCancelled
+}
+
+// runRegistry tracks in-flight and recently finished runs, indexed by run ID
+// and, while in flight, by session ID. Runs live in process memory, so
+// resuming or cancelling requires reaching the same replica.
+type runRegistry struct {
+	mu        sync.Mutex
+	runs      map[string]*Run
+	active    map[string]*Run
+	retention time.Duration
+}
+
+func newRunRegistry(retention time.Duration) *runRegistry {
+	return &runRegistry{
+		runs:      make(map[string]*Run),
+		active:    make(map[string]*Run),
+		retention: retention,
+	}
+}
+
+func (rr *runRegistry) add(run *Run) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.runs[run.ID] = run
+}
+
+// start marks run as the session's in-flight run once it stops waiting
+// behind earlier turns.
+func (rr *runRegistry) start(run *Run) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.active[run.SessionID] = run
+}
+
+// finish marks a run as no longer in flight and schedules its removal after
+// the retention period so late reconnects can still replay its events.
+func (rr *runRegistry) finish(run *Run) {
+	rr.mu.Lock()
+	if rr.active[run.SessionID] == run {
+		delete(rr.active, run.SessionID)
+	}
+	rr.mu.Unlock()
+
+	time.AfterFunc(rr.retention, func() {
+		rr.mu.Lock()
+		defer rr.mu.Unlock()
+		delete(rr.runs, run.ID)
+	})
+}
+
+// get returns the run with the given ID, or the in-flight run of the session
+// with that ID, if it is owned by userID.
+func (rr *runRegistry) get(id, userID string) (*Run, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	run, ok := rr.runs[id]
+	if !ok {
+		run, ok = rr.active[id]
+	}
+	if !ok || run.UserID != userID {
+		return nil, ErrRunNotFound
+	}
+	return run, nil
+}
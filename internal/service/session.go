@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/ai/flow"
+	"github.com/FPT-OJT/minstant-ai.git/internal/repository"
+)
+
+// SessionSummary is a chat session entry shown in a conversation list.
+type SessionSummary struct {
+	ID        string    `json:"id"`
+	Title     *string   `json:"title"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SessionList is one page of a user's chat sessions, newest first.
+type SessionList struct {
+	Sessions []SessionSummary `json:"sessions"`
+	Limit    int              `json:"limit"`
+	Offset   int              `json:"offset"`
+	HasMore  bool             `json:"hasMore"`
+}
+
+// ChatMessage is a single conversation message in a client-friendly shape.
+type ChatMessage struct {
+	ID      string `json:"id,omitempty"`
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Interrupted is true for an answer cut short by cancellation.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// SessionDetail is a chat session with its conversation messages.
+type SessionDetail struct {
+	SessionSummary
+	Messages []ChatMessage `json:"messages"`
+}
+
+// SessionRepository is the persistence required by SessionService.
+type SessionRepository interface {
+	ListSessions(ctx context.Context, userID string, limit, offset int) ([]repository.SessionSummary, error)
+	GetSession(ctx context.Context, userID, sessionID string) (*repository.SessionRecord, error)
+	UpdateTitle(ctx context.Context, userID, sessionID, title string) error
+	DeleteSession(ctx context.Context, userID, sessionID string) error
+}
+
+// SessionService manages a user's stored chat sessions.
+type SessionService interface {
+	ListSessions(ctx context.Context, userID string, limit, offset int) (*SessionList, error)
+	GetSession(ctx context.Context, userID, sessionID string) (*SessionDetail, error)
+	RenameSession(ctx context.Context, userID, sessionID, title string) error
+	DeleteSession(ctx context.Context, userID, sessionID string) error
+}
+
+type sessionService struct {
+	repo SessionRepository
+}
+
+// NewSessionService creates a SessionService backed by the given repository.
+func NewSessionService(repo SessionRepository) SessionService {
+	return &sessionService{repo: repo}
+}
+
+// listSessionPage returns up to limit sessions listed by list after offset,
+// and whether another page exists.
+func listSessionPage(ctx context.Context, list func(ctx context.Context, userID string, limit, offset int) ([]repository.SessionSummary, error), userID string, limit, offset int) ([]repository.SessionSummary, bool, error) {
+	// Fetch one extra row to learn whether another page exists.
+	rows, err := list(ctx, userID, limit+1, offset)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(rows) > limit {
+		return rows[:limit], true, nil
+	}
+	return rows, false, nil
+}
+
+func (s *sessionService) ListSessions(ctx context.Context, userID string, limit, offset int) (*SessionList, error) {
+	rows, hasMore, err := listSessionPage(ctx, s.repo.ListSessions, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &SessionList{
+		Sessions: make([]SessionSummary, 0, len(rows)),
+		Limit:    limit,
+		Offset:   offset,
+		HasMore:  hasMore,
+	}
+	for _, r := range rows {
+		list.Sessions = append(list.Sessions, toSessionSummary(r))
+	}
+
+	return list, nil
+}
+
+func (s *sessionService) GetSession(ctx context.Context, userID, sessionID string) (*SessionDetail, error) {
+	rec, err := s.repo.GetSession(ctx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionDetail{
+		SessionSummary: toSessionSummary(rec.SessionSummary),
+		Messages:       toChatMessages(rec.State.History),
+	}, nil
+}
+
+func (s *sessionService) RenameSession(ctx context.Context, userID, sessionID, title string) error {
+	return s.repo.UpdateTitle(ctx, userID, sessionID, title)
+}
+
+func (s *sessionService) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	return s.repo.DeleteSession(ctx, userID, sessionID)
+}
+
+func toSessionSummary(r repository.SessionSummary) SessionSummary {
+	return SessionSummary{
+		ID:        r.ID,
+		Title:     r.Title,
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+	}
+}
+
+// toChatMessages converts stored Genkit messages into user and assistant
+// text messages, dropping messages without visible text (e.g. tool calls).
+func toChatMessages(history []*ai.Message) []ChatMessage {
+	messages := make([]ChatMessage, 0, len(history))
+	for _, m := range history {
+		var role string
+		switch m.Role {
+		case ai.RoleUser:
+			role = "user"
+		case ai.RoleModel:
+			role = "assistant"
+		default:
+			continue
+		}
+
+		text := m.Text()
+		if text == "" {
+			continue
+		}
+		messages = append(messages, ChatMessage{
+			ID:          flow.MessageID(m),
+			Role:        role,
+			Content:     text,
+			Interrupted: flow.IsInterrupted(m),
+		})
+	}
+	return messages
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/repository"
+)
+
+func TestListSessionPage(t *testing.T) {
+	stored := make([]repository.SessionSummary, 5)
+	for i := range stored {
+		stored[i].ID = string(rune('a' + i))
+	}
+	list := func(_ context.Context, _ string, limit, offset int) ([]repository.SessionSummary, error) {
+		return stored[min(offset, len(stored)):min(offset+limit, len(stored))], nil
+	}
+
+	tests := []struct {
+		name        string
+		limit       int
+		offset      int
+		wantIDs     string
+		wantHasMore bool
+	}{
+		{"first page", 2, 0, "ab", true},
+		{"last full page", 2, 3, "de", false},
+		{"partial page", 3, 3, "de", false},
+		{"past the end", 2, 5, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, hasMore, err := listSessionPage(context.Background(), list, "u", tt.limit, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids string
+			for _, r := range rows {
+				ids += r.ID
+			}
+			if ids != tt.wantIDs || hasMore != tt.wantHasMore {
+				t.Fatalf("page = %q, hasMore %v, want %q, %v", ids, hasMore, tt.wantIDs, tt.wantHasMore)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/FPT-OJT/minstant-ai.git/internal/ai/flow"
+	"github.com/FPT-OJT/minstant-ai.git/internal/config"
+	"github.com/FPT-OJT/minstant-ai.git/internal/repository"
+)
+
+// Quota periods.
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// QuotaExceededError is returned by StartRun when the user has used up a
+// token quota.
+type QuotaExceededError struct {
+	// Period is PeriodDaily or PeriodMonthly.
+	Period   string
+	Limit    int64
+	Used     int64
+	ResetsAt time.Time
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s token quota exceeded: used %d of %d", e.Period, e.Used, e.Limit)
+}
+
+// UsagePeriod is a user's usage over a quota period.
+type UsagePeriod struct {
+	Turns        int64 `json:"turns"`
+	InputTokens  int64 `json:"inputTokens"`
+	OutputTokens int64 `json:"outputTokens"`
+	TotalTokens  int64 `json:"totalTokens"`
+	ModelCalls   int64 `json:"modelCalls"`
+	ToolCalls    int64 `json:"toolCalls"`
+	// Limit and Remaining are nil if the period's quota is unlimited.
+	Limit     *int64    `json:"limit"`
+	Remaining *int64    `json:"remaining"`
+	ResetsAt  time.Time `json:"resetsAt"`
+}
+
+// exceeded reports whether the period's quota is used up.
+func (p UsagePeriod) exceeded() bool {
+	return p.Limit != nil && p.TotalTokens >= *p.Limit
+}
+
+// UsageReport is a user's token usage in the current day and month.
+type UsageReport struct {
+	Plan    string      `json:"plan,omitempty"`
+	Daily   UsagePeriod `json:"daily"`
+	Monthly UsagePeriod `json:"monthly"`
+}
+
+// UsageRepository is the persistence required by UsageService.
+type UsageRepository interface {
+	RecordUsage(ctx context.Context, rec repository.UsageRecord) error
+	UsageSince(ctx context.Context, userID string, since time.Time) (repository.UsageTotals, error)
+	UserQuota(ctx context.Context, userID string) (repository.UserQuota, error)
+}
+
+// UsageService accounts the token usage of chat turns and enforces quotas.
+type UsageService interface {
+	// GetUsage returns the usage of userID, whose token carries plan.
+	GetUsage(ctx context.Context, userID, plan string) (*UsageReport, error)
+	// CheckQuota returns a *QuotaExceededError if userID has used up the
+	// daily or monthly quota.
+	CheckQuota(ctx context.Context, userID, plan string) error
+	// RecordUsage stores the usage of a finished turn.
+	RecordUsage(ctx context.Context, userID, runID string, result *ChatResult) error
+	// RecordSideUsage stores the usage of a turn's history summary or
+	// session title. It implements flow.UsageRecorder.
+	RecordSideUsage(ctx context.Context, userID string, u flow.SideUsage) error
+}
+
+type usageService struct {
+	cfg  config.QuotaConfig
+	repo UsageRepository
+	now  func() time.Time
+}
+
+// NewUsageService creates a UsageService enforcing the quotas of cfg.
+func NewUsageService(cfg config.QuotaConfig, repo UsageRepository) UsageService {
+	return &usageService{cfg: cfg, repo: repo, now: time.Now}
+}
+
+func (s *usageService) GetUsage(ctx context.Context, userID, plan string) (*UsageReport, error) {
+	limits, ok := s.cfg.Plans[plan]
+	if !ok {
+		limits = s.cfg.Default
+	}
+	override, err := s.repo.UserQuota(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if override.DailyTokens != nil {
+		limits.DailyTokens = *override.DailyTokens
+	}
+	if override.MonthlyTokens != nil {
+		limits.MonthlyTokens = *override.MonthlyTokens
+	}
+
+	now := s.now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	daily, err := s.period(ctx, userID, dayStart, dayStart.AddDate(0, 0, 1), limits.DailyTokens)
+	if err != nil {
+		return nil, err
+	}
+	monthly, err := s.period(ctx, userID, monthStart, monthStart.AddDate(0, 1, 0), limits.MonthlyTokens)
+	if err != nil {
+		return nil, err
+	}
+	return &UsageReport{Plan: plan, Daily: daily, Monthly: monthly}, nil
+}
+
+// period returns the usage of userID from start until end, with a quota of
+// limit tokens (zero for unlimited).
+func (s *usageService) period(ctx context.Context, userID string, start, end time.Time, limit int64) (UsagePeriod, error) {
+	t, err := s.repo.UsageSince(ctx, userID, start)
+	if err != nil {
+		return UsagePeriod{}, err
+	}
+	p := UsagePeriod{
+		Turns:        t.Turns,
+		InputTokens:  t.InputTokens,
+		OutputTokens: t.OutputTokens,
+		TotalTokens:  t.TotalTokens,
+		ModelCalls:   t.ModelCalls,
+		ToolCalls:    t.ToolCalls,
+		ResetsAt:     end,
+	}
+	if limit > 0 {
+		remaining := max(limit-t.TotalTokens, 0)
+		p.Limit, p.Remaining = &limit, &remaining
+	}
+	return p, nil
+}
+
+// CheckQuota only rejects turns once a quota is used up, so the last turn
+// before that may overshoot it.
+func (s *usageService) CheckQuota(ctx context.Context, userID, plan string) error {
+	report, err := s.GetUsage(ctx, userID, plan)
+	if err != nil {
+		return err
+	}
+	for _, p := range []struct {
+		name string
+		UsagePeriod
+	}{{PeriodDaily, report.Daily}, {PeriodMonthly, report.Monthly}} {
+		if p.exceeded() {
+			return &QuotaExceededError{Period: p.name, Limit: *p.Limit, Used: p.TotalTokens, ResetsAt: p.ResetsAt}
+		}
+	}
+	return nil
+}
+
+func (s *usageService) RecordUsage(ctx context.Context, userID, runID string, result *ChatResult) error {
+	u := result.Usage
+	return s.record(ctx, repository.UsageRecord{
+		UserID:       userID,
+		SessionID:    result.SessionID,
+		RunID:        runID,
+		Kind:         flow.UsageChat,
+		Model:        result.Model,
+		InputTokens:  u.InputTokens,
+		OutputTokens: u.OutputTokens,
+		TotalTokens:  u.TotalTokens,
+		ModelCalls:   u.ModelCalls,
+		ToolCalls:    u.ToolCalls,
+	})
+}
+
+func (s *usageService) RecordSideUsage(ctx context.Context, userID string, u flow.SideUsage) error {
+	return s.record(ctx, repository.UsageRecord{
+		UserID:       userID,
+		SessionID:    u.SessionID,
+		RunID:        u.RunID,
+		Kind:         u.Kind,
+		Model:        u.Model,
+		InputTokens:  u.Usage.InputTokens,
+		OutputTokens: u.Usage.OutputTokens,
+		TotalTokens:  u.Usage.TotalTokens,
+		ModelCalls:   u.Usage.ModelCalls,
+		ToolCalls:    u.Usage.ToolCalls,
+	})
+}
+
+// record stores rec unless it made no model call.
+func (s *usageService) record(ctx context.Context, rec repository.UsageRecord) error {
+	if rec.ModelCalls == 0 {
+		return nil
+	}
+	if rec.TotalTokens == 0 {
+		// Not every provider reports a total.
+		rec.TotalTokens = rec.InputTokens + rec.OutputTokens
+	}
+	if rec.TotalTokens == 0 {
+		log.Printf("warning: %s usage of run %s made %d model calls with %s but reported no token usage", rec.Kind, rec.RunID, rec.ModelCalls, rec.Model)
+	}
+	return s.repo.RecordUsage(ctx, rec)
+}